@@ -3,11 +3,12 @@ module github.com/NCNUCodeOJ/BackendUser
 go 1.15
 
 require (
-	github.com/appleboy/gin-jwt/v2 v2.7.0
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-gonic/gin v1.7.4
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.4.1
+	github.com/golang-jwt/jwt/v4 v4.1.0
 	github.com/joho/godotenv v1.4.0
-	github.com/meyskens/go-hcaptcha v0.0.0-20200428113538-5c28ead635cd
 	github.com/vincentinttsh/replace v1.0.2
 	github.com/vincentinttsh/zero v1.0.2
 	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"gorm.io/gorm"
+)
+
+const keyUsage = `usage:
+  key list                          列出所有金鑰
+  key add <HS512|RS256|EdDSA>       新增只用來驗證的金鑰，先讓其他服務取得公鑰
+  key promote <kid>                 改用這把金鑰簽署，原本的簽署金鑰改為只用來驗證
+  key retire <kid>                  停用金鑰，用這把金鑰簽署的 token 全部失效
+  key encrypt                       加密資料庫中尚未加密的私鑰與兩步驟驗證密鑰
+
+私鑰與兩步驟驗證密鑰以 SIGNING_KEY_ENCRYPTION_KEY 加密後存入資料庫`
+
+// keyCommand 管理 JWT 金鑰，執行中的服務會在一分鐘內套用
+func keyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(keyUsage)
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		keys, err := models.GetAllSigningKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Printf("%s\t%s\t%s\t%s\n", key.KID, key.Algorithm, key.Status, key.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		return nil
+	case args[0] == "add" && len(args) == 2:
+		key, data, err := pkg.GenerateSigningKey(args[1])
+		if err != nil {
+			return err
+		}
+		encrypted, err := pkg.EncryptPrivateKey(data)
+		if err != nil {
+			return err
+		}
+		err = models.CreateSigningKey(&models.SigningKey{
+			KID:        key.ID,
+			Algorithm:  key.Algorithm,
+			PrivateKey: encrypted,
+			Status:     models.SigningKeyStatusVerify,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(key.ID)
+		return nil
+	case args[0] == "promote" && len(args) == 2:
+		key, err := models.SigningKeyByKID(args[1])
+		if err != nil {
+			return err
+		}
+		if key.Status == models.SigningKeyStatusRetired {
+			return errors.New("key is retired")
+		}
+		return models.PromoteSigningKey(&key)
+	case args[0] == "retire" && len(args) == 2:
+		return retireKey(args[1])
+	case args[0] == "encrypt" && len(args) == 1:
+		return encryptKeys()
+	}
+	return errors.New(keyUsage)
+}
+
+// retireKey 停用金鑰，資料庫沒有的 kid（例如環境變數設定的金鑰）會留下停用紀錄
+func retireKey(kid string) error {
+	key, err := models.SigningKeyByKID(kid)
+	if err == nil {
+		if key.Status == models.SigningKeyStatusSigning {
+			return errors.New("cannot retire the signing key, promote another key first")
+		}
+		key.Status = models.SigningKeyStatusRetired
+		key.PrivateKey = ""
+		return models.UpdateSigningKey(&key)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	keys, err := models.GetAllSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if k.Status == models.SigningKeyStatusSigning {
+			return models.CreateSigningKey(&models.SigningKey{
+				KID:    kid,
+				Status: models.SigningKeyStatusRetired,
+			})
+		}
+	}
+	return errors.New("cannot retire the signing key, promote another key first")
+}
+
+// encryptKeys 加密在加入加密功能之前存入資料庫的私鑰與兩步驟驗證密鑰
+func encryptKeys() error {
+	keys, err := models.GetAllSigningKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.PrivateKey == "" || pkg.IsEncryptedPrivateKey(key.PrivateKey) {
+			continue
+		}
+		if key.PrivateKey, err = pkg.EncryptPrivateKey([]byte(key.PrivateKey)); err != nil {
+			return err
+		}
+		if err := models.UpdateSigningKey(&key); err != nil {
+			return err
+		}
+		fmt.Println(key.KID)
+	}
+
+	users, err := models.GetUsersWithTOTPSecret()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if pkg.IsEncryptedPrivateKey(user.TOTPSecret) {
+			continue
+		}
+		if user.TOTPSecret, err = pkg.EncryptTOTPSecret(user.TOTPSecret); err != nil {
+			return err
+		}
+		if err := models.UpdateUser(&user); err != nil {
+			return err
+		}
+		fmt.Println(user.UserName)
+	}
+	return nil
+}
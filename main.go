@@ -69,6 +69,11 @@ func main() {
 			os.Exit(1)
 		}
 		os.Exit(0)
+	} else if arg == "key" {
+		models.Setup()
+		if err := keyCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		start()
 		// Wait for interrupt signal to gracefully shutdown the server with
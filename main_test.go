@@ -2,19 +2,33 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
 	"github.com/NCNUCodeOJ/BackendUser/router"
 	"github.com/NCNUCodeOJ/BackendUser/views"
 	"github.com/gin-gonic/gin"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v4"
 	"gopkg.in/go-playground/assert.v1"
+	"gorm.io/gorm"
 )
 
 var d struct {
@@ -22,6 +36,7 @@ var d struct {
 }
 var userID string
 var userName = "vincent"
+var studentID = "s107213004"
 var userPath = "/api/v1/user"
 var password = "123456"
 var announcementsLength = 0
@@ -33,17 +48,45 @@ func contentType() (string, string) {
 
 func init() {
 	gin.SetMode(gin.TestMode)
+	// 需要 captcha 的測試自己設定假的服務
+	os.Setenv("CAPTCHA_PROVIDER", "disabled")
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "test key encryption key")
+	os.Setenv("OAUTH_ISSUER", "https://oj.ncnu.edu.tw/")
 	models.Setup()
 	views.Setup()
 }
 
+// setenv 設定環境變數並重新設定 views，回傳還原環境變數的函式
+func setenv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for key, value := range env {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+	views.Setup()
+	return func() {
+		for key, old := range previous {
+			if old == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *old)
+			}
+		}
+		views.Setup()
+	}
+}
+
 func TestUserRegister(t *testing.T) {
 	var data = []byte(`{
 		"username": "` + userName + `",
 		"password": "123456",
 		"realname": "郭子緯",
-		"email": "s107213004@ncnu.edu.tw",
-		"student_id": "s107213004",
+		"email": "` + studentID + `@ncnu.edu.tw",
+		"student_id": "` + studentID + `",
 		"avatar": "https://avatars0.githubusercontent.com/u/1234?v=4"
 	}`)
 	r := router.SetupRouter()
@@ -107,7 +150,42 @@ func TestRefresh(t *testing.T) {
 	body, _ := ioutil.ReadAll(w.Body)
 	old := d.Token
 	json.Unmarshal(body, &d)
-	assert.Equal(t, old, d.Token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// 換發的 token 有自己的 jti，撤銷其中一個不會影響另一個
+	oldClaims, newClaims := jwt.MapClaims{}, jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(old, oldClaims)
+	new(jwt.Parser).ParseUnverified(d.Token, newClaims)
+	assert.NotEqual(t, oldClaims["jti"], newClaims["jti"])
+	// 換發不會延長可以換發的期限
+	assert.Equal(t, oldClaims["orig_iat"], newClaims["orig_iat"])
+
+	// 以資料庫中目前的資料換發，停用的帳號不能換發也不能查詢
+	user := createUser(t, "refreshed")
+	token := loginAs(t, "refreshed", password)
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(`{"user_id": ["1"]}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+	user.Teacher = true
+	models.UpdateUser(&user)
+	w = request("GET", "/api/v1/token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshed := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &refreshed)
+	claims, _ := views.VerifyToken(refreshed.Token)
+	assert.Equal(t, true, claims["teacher"])
+
+	user.Suspended = true
+	models.UpdateUser(&user)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/token").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/api/v1/username").Code)
 }
 
 func TestUserInfo(t *testing.T) {
@@ -126,7 +204,7 @@ func TestUserInfo(t *testing.T) {
 
 func TestUserChangeInfo(t *testing.T) {
 	var data = []byte(`{
-		"student_id": "vincentinttsh"
+		"student_id": "s107213005"
 	}`)
 	r := router.SetupRouter()
 	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
@@ -144,7 +222,7 @@ func TestUserChangeInfo(t *testing.T) {
 		StudentID string `json:"student_id"`
 	}{}
 	json.Unmarshal(body, &s)
-	assert.Equal(t, "vincentinttsh", s.StudentID)
+	assert.Equal(t, "s107213005", s.StudentID)
 }
 
 func TestChangeUserPermissions(t *testing.T) {
@@ -159,6 +237,13 @@ func TestChangeUserPermissions(t *testing.T) {
 	req.Header.Set(contentType())
 	r.ServeHTTP(w, req)
 	assert.Equal(t, http.StatusOK, w.Code)
+	// 權限改變後舊的 token 立即失效
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	d.Token = login(t)
 	req, _ = http.NewRequest("GET", userPath, bytes.NewBuffer(make([]byte, 1000)))
 	req.Header.Set("Authorization", "Bearer "+d.Token)
 	w = httptest.NewRecorder()
@@ -206,6 +291,7 @@ func TestUserResetPassword(t *testing.T) {
 func TestUserName(t *testing.T) {
 	oldUserID := userID
 	userName = "vincentinttsh"
+	studentID = "s107213006"
 	TestUserRegister(t)
 	var data = []byte(`{
 		"user_id": ["` + userID + `","` + oldUserID + `"]
@@ -282,6 +368,2330 @@ func TestDeleteAnnouncement(t *testing.T) {
 	announcementsLength--
 	TestGetAllAnnouncement(t)
 }
+func login(t *testing.T) string {
+	return loginAs(t, "vincent", password)
+}
+
+func loginAs(t *testing.T, name, pwd string) string {
+	var data = []byte(`{
+		"username": "` + name + `",
+		"password": "` + pwd + `"
+	}`)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	return s.Token
+}
+
+func TestLogout(t *testing.T) {
+	token := login(t)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("DELETE", "/api/v1/token", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func refresh(t *testing.T, refreshToken string) (int, string) {
+	var data = []byte(`{
+		"refresh_token": "` + refreshToken + `"
+	}`)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", "/api/v1/token/refresh", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	s := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	return w.Code, s.RefreshToken
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	var data = []byte(`{
+		"username": "vincent",
+		"password": "` + password + `"
+	}`)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	s := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.NotEqual(t, "", s.RefreshToken)
+	userInfo := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", userPath, nil)
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	code, rotated := refresh(t, s.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, s.RefreshToken, rotated)
+	assert.Equal(t, http.StatusOK, userInfo())
+
+	// 重複使用時連同 session 一起撤銷，這個 session 的 access token 也不能再使用
+	code, _ = refresh(t, s.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusUnauthorized, userInfo())
+
+	code, _ = refresh(t, rotated)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// 沒有帶 refresh token 時不需要 CSRF token
+	for _, body := range []string{"", "{}"} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/api/v1/token/refresh", strings.NewReader(body))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.ServeHTTP(w, req)
+	s := struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, len(s.Keys))
+}
+
+func TestKeyRotation(t *testing.T) {
+	assert.Equal(t, nil, keyCommand([]string{"add", "EdDSA"}))
+	keys, _ := models.GetAllSigningKeys()
+	kid := keys[len(keys)-1].KID
+	// 資料庫中只有加密過的私鑰
+	assert.Equal(t, true, pkg.IsEncryptedPrivateKey(keys[len(keys)-1].PrivateKey))
+	assert.Equal(t, nil, keyCommand([]string{"promote", kid}))
+	views.Setup()
+
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.ServeHTTP(w, req)
+	s := struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.Equal(t, 1, len(s.Keys))
+	assert.Equal(t, kid, s.Keys[0]["kid"])
+
+	// 舊金鑰簽署的 token 在停用前仍然有效
+	token := login(t)
+	for _, v := range []string{d.Token, token} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", userPath, nil)
+		req.Header.Set("Authorization", "Bearer "+v)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.NotEqual(t, nil, keyCommand([]string{"retire", kid}))
+	assert.Equal(t, nil, keyCommand([]string{"retire", "default"}))
+	views.Setup()
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+d.Token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	d.Token = token
+}
+
+func createUser(t *testing.T, name string) models.User {
+	pwd, _ := pkg.Encrypt(password)
+	user := models.User{
+		UserName:  name,
+		Password:  pwd,
+		RealName:  name,
+		Email:     name + "@ncnu.edu.tw",
+		StudentID: name,
+	}
+	assert.Equal(t, nil, models.CreateUser(&user))
+	return user
+}
+
+func TestTOTP(t *testing.T) {
+	createUser(t, "totp")
+	token := loginAs(t, "totp", password)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", userPath+"/totp", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	enroll := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &enroll)
+	assert.Equal(t, true, strings.HasPrefix(enroll.URI, "otpauth://totp/"))
+	// 資料庫中只保存加密過的密鑰
+	stored, _ := models.UserDetailByUserName("totp")
+	assert.NotEqual(t, enroll.Secret, stored.TOTPSecret)
+	assert.Equal(t, true, pkg.IsEncryptedPrivateKey(stored.TOTPSecret))
+	users, _ := models.GetUsersWithTOTPSecret()
+	assert.NotEqual(t, 0, len(users))
+
+	step := pkg.TOTPStep(time.Now())
+	code := func(i int64) string {
+		c, _ := pkg.TOTPCode(enroll.Secret, step+i)
+		return c
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", userPath+"/totp/confirm", bytes.NewBufferString(`{"code": "`+code(-1)+`"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// 密碼正確後只拿到 mfa token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token", bytes.NewBufferString(`{"username": "totp", "password": "`+password+`"}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	first := struct {
+		Token    string `json:"token"`
+		MFAToken string `json:"mfa_token"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &first)
+	assert.Equal(t, "", first.Token)
+	assert.NotEqual(t, "", first.MFAToken)
+
+	// mfa token 不能當作 access token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+first.MFAToken)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 用過的驗證碼不能再用
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+first.MFAToken+`", "code": "`+code(-1)+`"}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+first.MFAToken+`", "code": "`+code(0)+`"}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", userPath+"/totp", bytes.NewBufferString(`{"password": "`+password+`", "code": "`+code(1)+`"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRecoveryCodeAndTrustedDevice(t *testing.T) {
+	createUser(t, "recovery")
+	token := loginAs(t, "recovery", password)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", userPath+"/totp", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	enroll := struct {
+		Secret string `json:"secret"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &enroll)
+	code, _ := pkg.TOTPCode(enroll.Secret, pkg.TOTPStep(time.Now()))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", userPath+"/totp/confirm", bytes.NewBufferString(`{"code": "`+code+`"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	confirm := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &confirm)
+	assert.Equal(t, 10, len(confirm.RecoveryCodes))
+
+	mfaLogin := func(cookie *http.Cookie) (int, string, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBufferString(`{"username": "recovery", "password": "`+password+`"}`))
+		req.Header.Set(contentType())
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(w, req)
+		s := struct {
+			Token    string `json:"token"`
+			MFAToken string `json:"mfa_token"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return w.Code, s.Token, s.MFAToken
+	}
+
+	_, _, mfaToken := mfaLogin(nil)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+mfaToken+`", "recovery_code": "`+strings.ToUpper(confirm.RecoveryCodes[0])+`", "trust_device": true}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	// mfa token 只能使用一次，重複使用不會記錄為登入成功
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+mfaToken+`", "recovery_code": "`+confirm.RecoveryCodes[1]+`"}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	user, _ := models.UserDetailByUserName("recovery")
+	attempts, _ := models.GetLoginAttemptsByUserID(user.ID, 1)
+	assert.Equal(t, false, attempts[0].Success)
+	assert.Equal(t, "invalid_token", attempts[0].Reason)
+
+	// 備用碼只能使用一次
+	_, _, mfaToken = mfaLogin(nil)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+mfaToken+`", "recovery_code": "`+confirm.RecoveryCodes[0]+`"}`))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 信任的瀏覽器不需要驗證碼
+	status, accessToken, _ := mfaLogin(cookies[0])
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, "", accessToken)
+
+	trust := func(recoveryCode string) *http.Cookie {
+		_, _, mfaToken := mfaLogin(nil)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/token/totp", bytes.NewBufferString(`{"mfa_token": "`+mfaToken+`", "recovery_code": "`+recoveryCode+`", "trust_device": true}`))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == "trusted_device" {
+				return cookie
+			}
+		}
+		return &http.Cookie{}
+	}
+	// 正式環境沒有啟用 cookie 模式時，前端與 API 可能在不同網域，以 SameSite=None 傳送
+	gin.SetMode(gin.ReleaseMode)
+	defer gin.SetMode(gin.TestMode)
+	cookie := trust(confirm.RecoveryCodes[2])
+	assert.Equal(t, http.SameSiteNoneMode, cookie.SameSite)
+	assert.Equal(t, true, cookie.Secure)
+	// 啟用 cookie 模式時依 COOKIE_SAME_SITE 設定
+	restore := setenv(map[string]string{"COOKIE_SESSION": "1", "COOKIE_SAME_SITE": "strict"})
+	defer restore()
+	cookie = trust(confirm.RecoveryCodes[3])
+	assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+	assert.Equal(t, true, cookie.Secure)
+}
+
+// softAuthenticator 測試用的軟體驗證器，以 ES256 金鑰模擬 passkey
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func cborHead(major byte, n int) []byte {
+	if n < 24 {
+		return []byte{major<<5 | byte(n)}
+	}
+	if n < 256 {
+		return []byte{major<<5 | 24, byte(n)}
+	}
+	return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+}
+
+func cborInt(n int) []byte {
+	if n >= 0 {
+		return cborHead(0, n)
+	}
+	return cborHead(1, -1-n)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	a.signCount++
+	counter := make([]byte, 4)
+	binary.BigEndian.PutUint32(counter, a.signCount)
+	var flags byte = 0x05 // UP | UV
+	if attested {
+		flags |= 0x40 // AT
+	}
+	data := append(append(rpIDHash[:], flags), counter...)
+	if attested {
+		data = append(data, make([]byte, 16)...) // aaguid
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, cborHead(5, 5)...)
+		data = append(data, cborInt(1)...)
+		data = append(data, cborInt(2)...)
+		data = append(data, cborInt(3)...)
+		data = append(data, cborInt(-7)...)
+		data = append(data, cborInt(-1)...)
+		data = append(data, cborInt(1)...)
+		data = append(data, cborInt(-2)...)
+		data = append(data, cborBytes(a.key.X.FillBytes(make([]byte, 32)))...)
+		data = append(data, cborInt(-3)...)
+		data = append(data, cborBytes(a.key.Y.FillBytes(make([]byte, 32)))...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	return []byte(`{"type":"` + ceremony + `","challenge":"` + challenge + `","origin":"http://localhost"}`)
+}
+
+func (a *softAuthenticator) create(challenge string) gin.H {
+	attestation := append(cborHead(5, 3), append(cborHead(3, 3), "fmt"...)...)
+	attestation = append(attestation, append(cborHead(3, 4), "none"...)...)
+	attestation = append(attestation, append(cborHead(3, 7), "attStmt"...)...)
+	attestation = append(attestation, cborHead(5, 0)...)
+	attestation = append(attestation, append(cborHead(3, 8), "authData"...)...)
+	attestation = append(attestation, cborBytes(a.authData(true))...)
+	return gin.H{
+		"id": pkg.WebAuthnEncode(a.credentialID),
+		"response": gin.H{
+			"clientDataJSON":    pkg.WebAuthnEncode(a.clientData("webauthn.create", challenge)),
+			"attestationObject": pkg.WebAuthnEncode(attestation),
+		},
+	}
+}
+
+func (a *softAuthenticator) get(challenge, userHandle string) gin.H {
+	authData := a.authData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	return gin.H{
+		"id": pkg.WebAuthnEncode(a.credentialID),
+		"response": gin.H{
+			"clientDataJSON":    pkg.WebAuthnEncode(clientData),
+			"authenticatorData": pkg.WebAuthnEncode(authData),
+			"signature":         pkg.WebAuthnEncode(signature),
+			"userHandle":        pkg.WebAuthnEncode([]byte(userHandle)),
+		},
+	}
+}
+
+func TestPasskey(t *testing.T) {
+	user := createUser(t, "passkey")
+	token := loginAs(t, "passkey", password)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	authenticator := &softAuthenticator{key: key, credentialID: []byte("soft-authenticator")}
+	options := struct {
+		Session   string `json:"session"`
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}{}
+
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", userPath+"/passkeys/options", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &options)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, _ := json.Marshal(gin.H{
+		"session":    options.Session,
+		"name":       "soft",
+		"credential": authenticator.create(options.PublicKey.Challenge),
+	})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", userPath+"/passkeys", bytes.NewBuffer(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/passkey/options", nil)
+	r.ServeHTTP(w, req)
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &options)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	data, _ = json.Marshal(gin.H{
+		"session":    options.Session,
+		"credential": authenticator.get(options.PublicKey.Challenge, strconv.FormatUint(uint64(user.ID), 10)),
+	})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/passkey", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.NotEqual(t, "", s.Token)
+
+	// 同一個 assertion 不能重送
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/passkey", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath+"/passkeys", nil)
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	r.ServeHTTP(w, req)
+	list := struct {
+		Passkeys []struct {
+			Name string `json:"name"`
+		} `json:"passkeys"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &list)
+	assert.Equal(t, 1, len(list.Passkeys))
+	assert.Equal(t, "soft", list.Passkeys[0].Name)
+}
+
+// fakeIdP 測試用的 OpenID Connect provider
+type fakeIdP struct {
+	server *httptest.Server
+	key    *pkg.SigningKey
+	codes  map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeIdP() *fakeIdP {
+	idp := &fakeIdP{codes: map[string]fakeAuthorization{}}
+	idp.key, _, _ = pkg.GenerateSigningKey("RS256")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gin.H{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gin.H{"keys": []interface{}{idp.key.JWK()}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		authorization, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		if clientID != "backend" || secret != "secret" || !ok ||
+			pkg.PKCEChallenge(r.PostFormValue("code_verifier")) != authorization.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(gin.H{"error": "invalid_grant"})
+			return
+		}
+		idToken, _ := idp.key.Sign(authorization.claims)
+		json.NewEncoder(w).Encode(gin.H{"id_token": idToken, "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	return idp
+}
+
+// authorize 模擬使用者在 provider 同意授權，回傳 authorization code 與 state
+func (idp *fakeIdP) authorize(authorizationURL string, claims jwt.MapClaims) (string, string) {
+	u, _ := url.Parse(authorizationURL)
+	query := u.Query()
+	claims["iss"] = idp.server.URL
+	claims["aud"] = query.Get("client_id")
+	claims["nonce"] = query.Get("nonce")
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	code, _ := pkg.RandomToken(16)
+	idp.codes[code] = fakeAuthorization{challenge: query.Get("code_challenge"), claims: claims}
+	return code, query.Get("state")
+}
+
+func oidcLogin(t *testing.T, idp *fakeIdP, claims jwt.MapClaims, wrongState bool) (int, jwt.MapClaims) {
+	r := router.SetupRouter()
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("GET", "/api/v1/oidc/fake", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		Session          string `json:"session"`
+		AuthorizationURL string `json:"authorization_url"`
+		Token            string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+
+	code, state := idp.authorize(s.AuthorizationURL, claims)
+	if wrongState {
+		state = "wrong"
+	}
+	data, _ := json.Marshal(gin.H{
+		"session": s.Session,
+		"code":    code,
+		"state":   state,
+	})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/token/oidc", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	if w.Code != http.StatusOK {
+		return w.Code, nil
+	}
+	tokenClaims, err := views.VerifyToken(s.Token)
+	assert.Equal(t, nil, err)
+	return w.Code, tokenClaims
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP()
+	defer idp.server.Close()
+	env := map[string]string{
+		"OIDC_PROVIDERS":          "fake",
+		"OIDC_FAKE_ISSUER":        idp.server.URL,
+		"OIDC_FAKE_CLIENT_ID":     "backend",
+		"OIDC_FAKE_CLIENT_SECRET": "secret",
+		"OIDC_FAKE_REDIRECT_URL":  "http://localhost/oidc/callback",
+		"OIDC_FAKE_LINK_EMAIL":    "1",
+		"OIDC_FAKE_AUTO_CREATE":   "1",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	views.Setup()
+	defer views.Setup()
+	createUser(t, "oidclink")
+
+	// 已驗證的 email 綁定到既有帳號
+	status, claims := oidcLogin(t, idp, jwt.MapClaims{
+		"sub":            "fake-1",
+		"email":          "oidclink@ncnu.edu.tw",
+		"email_verified": true,
+	}, false)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "oidclink", claims["username"])
+
+	// 綁定後以 subject 找到帳號
+	status, claims = oidcLogin(t, idp, jwt.MapClaims{"sub": "fake-1"}, false)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "oidclink", claims["username"])
+
+	// 未驗證的 email 不會綁定，而是建立新帳號
+	status, claims = oidcLogin(t, idp, jwt.MapClaims{
+		"sub":                "fake-2",
+		"email":              "oidclink@ncnu.edu.tw",
+		"email_verified":     false,
+		"preferred_username": "new.comer",
+		"name":               "新同學",
+	}, false)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "newcomer", claims["username"])
+	user, err := models.UserDetailByUserName("newcomer")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "新同學", user.RealName)
+	assert.Equal(t, "", user.Email)
+
+	status, _ = oidcLogin(t, idp, jwt.MapClaims{"sub": "fake-1"}, true)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	os.Setenv("OIDC_FAKE_AUTO_CREATE", "0")
+	views.Setup()
+	status, _ = oidcLogin(t, idp, jwt.MapClaims{"sub": "fake-3"}, false)
+	assert.Equal(t, http.StatusForbidden, status)
+
+	token := loginAs(t, "oidclink", password)
+	r := router.SetupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", userPath+"/identities", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	s := struct {
+		Identities []struct {
+			ID       uint   `json:"identity_id"`
+			Provider string `json:"provider"`
+		} `json:"identities"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.Equal(t, 1, len(s.Identities))
+	assert.Equal(t, "fake", s.Identities[0].Provider)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", userPath+"/identities/"+strconv.FormatUint(uint64(s.Identities[0].ID), 10), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestOAuthProvider(t *testing.T) {
+	createUser(t, "oauthuser")
+	adminToken := login(t)
+	token := loginAs(t, "oauthuser", password)
+	redirectURI := "https://moodle.ncnu.edu.tw/admin/oauth2callback.php"
+
+	r := router.SetupRouter()
+	discovery := func(host string) (int, string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+		req.Host = host
+		req.Header.Set("X-Forwarded-Proto", "https")
+		r.ServeHTTP(w, req)
+		s := struct {
+			Issuer string `json:"issuer"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return w.Code, s.Issuer
+	}
+	// 沒有設定 OAUTH_ISSUER 時不提供 OAuth 服務
+	restore := setenv(map[string]string{"OAUTH_ISSUER": ""})
+	status, _ := discovery("oj.ncnu.edu.tw")
+	assert.Equal(t, http.StatusNotFound, status)
+	restore()
+	// issuer 固定為設定的值，不受請求的 Host 影響
+	status, issuer := discovery("evil.example.com")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "https://oj.ncnu.edu.tw", issuer)
+
+	data, _ := json.Marshal(gin.H{"name": "Moodle", "redirect_uris": []string{redirectURI}})
+	w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+	req, _ := http.NewRequest("POST", "/api/v1/oauth/clients", bytes.NewBuffer(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/oauth/clients", bytes.NewBuffer(data))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	client := struct {
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &client)
+
+	verifier, _ := pkg.RandomToken(32)
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {pkg.PKCEChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	authorization := struct {
+		ConsentRequired bool   `json:"consent_required"`
+		RedirectURI     string `json:"redirect_uri"`
+	}{}
+	authorize := func(method string) int {
+		w := httptest.NewRecorder()
+		var req *http.Request
+		if method == "GET" {
+			req, _ = http.NewRequest("GET", "/api/v1/oauth/authorize?"+query.Encode(), nil)
+		} else {
+			request := gin.H{"approve": true}
+			for key := range query {
+				request[key] = query.Get(key)
+			}
+			data, _ := json.Marshal(request)
+			req, _ = http.NewRequest("POST", "/api/v1/oauth/authorize", bytes.NewBuffer(data))
+			req.Header.Set(contentType())
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &authorization)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, authorize("GET"))
+	assert.Equal(t, true, authorization.ConsentRequired)
+	assert.Equal(t, http.StatusOK, authorize("POST"))
+	callback, _ := url.Parse(authorization.RedirectURI)
+	assert.Equal(t, "xyz", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+	assert.Equal(t, http.StatusOK, authorize("GET"))
+	assert.Equal(t, false, authorization.ConsentRequired)
+
+	// 沒有註冊的 redirect uri 不能導回
+	query.Set("redirect_uri", "https://evil.example.com/callback")
+	assert.Equal(t, http.StatusBadRequest, authorize("GET"))
+
+	exchange := func(code, verifier string) (int, []byte) {
+		form := url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {redirectURI},
+			"code_verifier": {verifier},
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ClientID, client.ClientSecret)
+		r.ServeHTTP(w, req)
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Code, body
+	}
+	status, body = exchange(code, verifier)
+	assert.Equal(t, http.StatusOK, status)
+	tokens := struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}{}
+	json.Unmarshal(body, &tokens)
+
+	// 以 JWKS 驗證 ID token
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	r.ServeHTTP(w, req)
+	jwks := struct {
+		Keys []pkg.JWK `json:"keys"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &jwks)
+	claims, err := pkg.ParseToken(tokens.IDToken, func(kid string) *pkg.SigningKey {
+		for _, jwk := range jwks.Keys {
+			if jwk.Kid == kid {
+				key, _ := pkg.ParseJWK(jwk)
+				return key
+			}
+		}
+		return nil
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, client.ClientID, claims["aud"])
+	assert.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	assert.Equal(t, "https://oj.ncnu.edu.tw", claims["iss"])
+	// auth_time 為登入建立 session 的時間
+	sessionClaims, _ := views.VerifyToken(token)
+	session, _ := models.SessionBySID(sessionClaims["sid"].(string))
+	assert.Equal(t, float64(session.CreatedAt.Unix()), claims["auth_time"])
+	assert.Equal(t, "oauthuser", claims["username"])
+	assert.Equal(t, false, claims["admin"])
+	assert.Equal(t, false, claims["teacher"])
+
+	// code 只能使用一次
+	status, _ = exchange(code, verifier)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/oauth/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	userInfo := struct {
+		Username string `json:"username"`
+		Name     string `json:"name"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &userInfo)
+	assert.Equal(t, "oauthuser", userInfo.Username)
+
+	// 簽發給 client 的 token 不能存取本服務的 API
+	for _, clientToken := range []string{tokens.AccessToken, tokens.IDToken} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", userPath, nil)
+		req.Header.Set("Authorization", "Bearer "+clientToken)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	userInfoStatus := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/oauth/userinfo", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 帳號停用後不能換取 token，已簽發的 token 也不能查詢使用者資訊
+	query.Set("redirect_uri", redirectURI)
+	assert.Equal(t, http.StatusOK, authorize("POST"))
+	callback, _ = url.Parse(authorization.RedirectURI)
+	user, _ := models.UserDetailByUserName("oauthuser")
+	user.Suspended = true
+	models.UpdateUser(&user)
+	status, _ = exchange(callback.Query().Get("code"), verifier)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, http.StatusUnauthorized, userInfoStatus())
+	user.Suspended = false
+	models.UpdateUser(&user)
+	assert.Equal(t, http.StatusOK, userInfoStatus())
+
+	// 撤銷授權後 token 失效，還沒換取的 code 也不能使用
+	assert.Equal(t, http.StatusOK, authorize("POST"))
+	callback, _ = url.Parse(authorization.RedirectURI)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", userPath+"/oauth/consents/"+client.ClientID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, userInfoStatus())
+	status, _ = exchange(callback.Query().Get("code"), verifier)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, http.StatusOK, authorize("GET"))
+	assert.Equal(t, true, authorization.ConsentRequired)
+
+}
+
+// fakeLDAP 測試用的目錄服務，只支援 simple bind 與以 uid 搜尋
+type fakeLDAP struct {
+	listener net.Listener
+	baseDN   string
+	users    map[string]fakeLDAPUser
+}
+
+type fakeLDAPUser struct {
+	password   string
+	attributes map[string]string
+}
+
+func newFakeLDAP(baseDN string, users map[string]fakeLDAPUser) *fakeLDAP {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	directory := &fakeLDAP{listener: listener, baseDN: baseDN, users: users}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go directory.serve(conn)
+		}
+	}()
+	return directory
+}
+
+func ldapMessage(id int64, op *ber.Packet) []byte {
+	message := ber.NewSequence("")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	message.AppendChild(op)
+	return message.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return result
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := false
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			uid := strings.TrimSuffix(strings.TrimPrefix(dn, "uid="), ","+f.baseDN)
+			user, ok := f.users[uid]
+			bound = ok && password != "" && password == user.password && dn == "uid="+uid+","+f.baseDN
+			code := ldap.LDAPResultInvalidCredentials
+			if bound {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter := op.Children[6]
+			uid := filter.Children[1].Data.String()
+			if user, ok := f.users[uid]; ok && bound && filter.Children[0].Data.String() == "uid" {
+				entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+				entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "uid="+uid+","+f.baseDN, ""))
+				attributes := ber.NewSequence("")
+				for name, value := range user.attributes {
+					attribute := ber.NewSequence("")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+				entry.AppendChild(attributes)
+				conn.Write(ldapMessage(id, entry))
+			}
+			conn.Write(ldapMessage(id, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPLogin(t *testing.T) {
+	baseDN := "ou=people,dc=ncnu,dc=edu,dc=tw"
+	directory := newFakeLDAP(baseDN, map[string]fakeLDAPUser{
+		"s110213001": {password: "campus", attributes: map[string]string{
+			"mail":        "s110213001@mail1.ncnu.edu.tw",
+			"displayName": "王小明",
+			"ncnuID":      "s110213001",
+		}},
+		// 與本地帳號同名的目錄帳號
+		userName: {password: "directory"},
+	})
+	defer directory.listener.Close()
+	env := map[string]string{
+		"AUTH_BACKENDS":             "local,ldap",
+		"LDAP_URL":                  "ldap://" + directory.listener.Addr().String(),
+		"LDAP_USER_DN":              "uid=%s," + baseDN,
+		"LDAP_BASE_DN":              baseDN,
+		"LDAP_STUDENT_ID_ATTRIBUTE": "ncnuID",
+		// 不以 sudo middleware 保護兩步驟驗證的設定，由 handler 確認密碼
+		"SUDO_ROUTES": "POST /api/v1/user/impersonate",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	views.Setup()
+	defer views.Setup()
+
+	loginStatus := func(name, pwd string) int {
+		data, _ := json.Marshal(gin.H{"username": name, "password": pwd})
+		r := router.SetupRouter()
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 第一次登入時建立 shadow user
+	assert.Equal(t, http.StatusOK, loginStatus("s110213001", "campus"))
+	user, err := models.UserDetailByUserName("s110213001")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ldap", user.AuthBackend)
+	assert.Equal(t, "王小明", user.RealName)
+	assert.Equal(t, "s110213001@mail1.ncnu.edu.tw", user.Email)
+	assert.Equal(t, "s110213001", user.StudentID)
+	assert.Equal(t, http.StatusOK, loginStatus("s110213001", "campus"))
+
+	assert.Equal(t, http.StatusUnauthorized, loginStatus("s110213001", "wrong"))
+	assert.Equal(t, http.StatusUnauthorized, loginStatus("s110213001", ""))
+	// 本地帳號仍然使用本地密碼（TestUserRegister 註冊時的密碼），不能以同名的目錄帳號登入
+	assert.Equal(t, http.StatusOK, loginStatus(userName, "123456"))
+	assert.Equal(t, http.StatusUnauthorized, loginStatus(userName, "directory"))
+
+	// 目錄帳號沒有本地密碼，以目錄服務的密碼確認身分
+	token := loginAs(t, "s110213001", "campus")
+	r := router.SetupRouter()
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, userPath+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+	enroll := struct {
+		Secret string `json:"secret"`
+	}{}
+	body, _ := ioutil.ReadAll(request("POST", "/totp", "").Body)
+	json.Unmarshal(body, &enroll)
+	step := pkg.TOTPStep(time.Now())
+	code, _ := pkg.TOTPCode(enroll.Secret, step-1)
+	assert.Equal(t, http.StatusOK, request("POST", "/totp/confirm", `{"code": "`+code+`"}`).Code)
+	// 登入後一段時間內不需要再輸入密碼
+	assert.Equal(t, http.StatusOK, request("POST", "/totp/recovery_codes", "").Code)
+
+	claims, _ := views.VerifyToken(token)
+	models.ElevateSession(claims["sid"].(string), time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/totp/recovery_codes", `{"password": "wrong"}`).Code)
+	assert.Equal(t, http.StatusOK, request("POST", "/totp/recovery_codes", `{"password": "campus"}`).Code)
+	code, _ = pkg.TOTPCode(enroll.Secret, step)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/totp", `{"password": "campus", "code": "`+code+`"}`).Code)
+}
+
+func TestLoginLockout(t *testing.T) {
+	user := createUser(t, "lockout")
+	adminToken := login(t)
+	r := router.SetupRouter()
+	attempt := func(pwd string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(gin.H{"username": "lockout", "password": pwd})
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		req.RemoteAddr = "198.51.100.7:4321"
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// 跳過退避時間
+	skipBackoff := func() {
+		models.LockLoginThrottle("user:lockout", time.Time{})
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, attempt("wrong").Code)
+	}
+	// 第三次失敗後開始退避，密碼正確也要等待
+	w := attempt(password)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	throttle, err := models.LoginThrottleByTarget("user:lockout")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, throttle.Failures)
+
+	skipBackoff()
+	assert.Equal(t, http.StatusOK, attempt(password).Code)
+	_, err = models.LoginThrottleByTarget("user:lockout")
+	assert.Equal(t, gorm.ErrRecordNotFound, err)
+
+	for i := 0; i < 10; i++ {
+		skipBackoff()
+		assert.Equal(t, http.StatusUnauthorized, attempt("wrong").Code)
+	}
+	w = attempt(password)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.Equal(t, true, retryAfter > 14*60)
+
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", userPath+"/lockouts", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	lockouts := struct {
+		Lockouts []struct {
+			Username string `json:"username"`
+			Failures int    `json:"failures"`
+		} `json:"lockouts"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &lockouts)
+	assert.Equal(t, 1, len(lockouts.Lockouts))
+	assert.Equal(t, "lockout", lockouts.Lockouts[0].Username)
+	assert.Equal(t, 10, lockouts.Lockouts[0].Failures)
+
+	for _, unlock := range []gin.H{{"user_id": user.ID}, {"ip": "198.51.100.7"}} {
+		data, _ := json.Marshal(unlock)
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", userPath+"/unlock", bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, http.StatusOK, attempt(password).Code)
+}
+
+func TestLoginByEmailOrStudentID(t *testing.T) {
+	user := createUser(t, "identifier")
+	user.StudentID = "s110213101"
+	assert.Equal(t, nil, models.UpdateUser(&user))
+
+	assert.NotEqual(t, "", loginAs(t, "Identifier@NCNU.edu.tw", password))
+	assert.NotEqual(t, "", loginAs(t, "S110213101", password))
+
+	r := router.SetupRouter()
+	register := func(name, email, studentID string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(gin.H{
+			"username":   name,
+			"password":   password,
+			"realname":   name,
+			"email":      email,
+			"student_id": studentID,
+		})
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", userPath, bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusUnauthorized, register("identifier2", "IDENTIFIER@ncnu.edu.tw", "s110213102").Code)
+	assert.Equal(t, http.StatusUnauthorized, register("identifier2", "identifier2@ncnu.edu.tw", "s110213101").Code)
+	assert.Equal(t, http.StatusUnauthorized, register("s110213101", "identifier2@ncnu.edu.tw", "s110213102").Code)
+	assert.Equal(t, http.StatusUnauthorized, register("identifier2", "identifier2@ncnu.edu.tw", "identifier").Code)
+	assert.Equal(t, http.StatusUnauthorized, register("identifier2", "identifier2@ncnu.edu.tw", "IDENTIFIER").Code)
+	assert.Equal(t, http.StatusUnauthorized, register("S110213101", "identifier2@ncnu.edu.tw", "s110213102").Code)
+	assert.Equal(t, http.StatusOK, register("identifier2", "identifier2@ncnu.edu.tw", "s110213102").Code)
+
+	token := loginAs(t, "s110213102", password)
+	for path, change := range map[string]gin.H{userPath + "/email": {"email": "identifier@ncnu.edu.tw"}, userPath: {"student_id": "s110213101"}} {
+		data, _ := json.Marshal(change)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", path, bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+
+	// 資料庫的唯一索引也不分大小寫，避免同時註冊時繞過檢查
+	pwd, _ := pkg.Encrypt(password)
+	duplicate := models.User{UserName: "identifier3", Password: pwd, RealName: "identifier3", Email: "IDENTIFIER@ncnu.edu.tw", StudentID: "s110213103"}
+	assert.NotEqual(t, nil, models.CreateUser(&duplicate))
+	duplicate = models.User{UserName: "identifier3", Password: pwd, RealName: "identifier3", Email: "identifier3@ncnu.edu.tw", StudentID: "S110213101"}
+	assert.NotEqual(t, nil, models.CreateUser(&duplicate))
+}
+
+func TestSessions(t *testing.T) {
+	user := createUser(t, "sessions")
+	adminToken := login(t)
+	r := router.SetupRouter()
+	loginFrom := func(userAgent string) (string, string) {
+		data, _ := json.Marshal(gin.H{"username": "sessions", "password": password})
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		req.Header.Set("User-Agent", userAgent)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		s := struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return s.Token, s.RefreshToken
+	}
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	type session struct {
+		SessionID uint   `json:"session_id"`
+		Device    string `json:"device"`
+		Current   bool   `json:"current"`
+	}
+	sessions := func(path, token string) []session {
+		w := request("GET", path, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		s := struct {
+			Sessions []session `json:"sessions"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return s.Sessions
+	}
+
+	laptop, _ := loginFrom("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36")
+	phone, phoneRefresh := loginFrom("Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1")
+
+	list := sessions(userPath+"/sessions", laptop)
+	assert.Equal(t, 2, len(list))
+	var phoneSession session
+	for _, s := range list {
+		if s.Current {
+			assert.Equal(t, "Chrome on Windows", s.Device)
+		} else {
+			phoneSession = s
+		}
+	}
+	assert.Equal(t, "Safari on iPhone", phoneSession.Device)
+
+	// 撤銷手機的 session 後，access token 與 refresh token 都不能再使用
+	w := request("DELETE", userPath+"/sessions/"+strconv.FormatUint(uint64(phoneSession.SessionID), 10), laptop)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, phone).Code)
+	data, _ := json.Marshal(gin.H{"refresh_token": phoneRefresh})
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/token/refresh", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 登出其他所有裝置，目前的裝置不受影響
+	tablet, _ := loginFrom("Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0")
+	w = request("DELETE", userPath+"/sessions", laptop)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, tablet).Code)
+	assert.Equal(t, http.StatusOK, request("GET", userPath, laptop).Code)
+	assert.Equal(t, 1, len(sessions(userPath+"/sessions", laptop)))
+
+	// 一般使用者不能查看別人的 session，管理員可以強制登出
+	other := userPath + "/sessions?user_id=" + userID
+	assert.Equal(t, http.StatusForbidden, request("GET", other, laptop).Code)
+	other = userPath + "/sessions?user_id=" + strconv.FormatUint(uint64(user.ID), 10)
+	assert.Equal(t, 1, len(sessions(other, adminToken)))
+	assert.Equal(t, http.StatusOK, request("DELETE", other, adminToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, laptop).Code)
+	assert.Equal(t, http.StatusOK, request("GET", userPath, adminToken).Code)
+}
+
+func TestPersonalAccessToken(t *testing.T) {
+	createUser(t, "pat")
+	token := loginAs(t, "pat", password)
+	r := router.SetupRouter()
+	request := func(method, path, token string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", userPath+"/tokens", token, gin.H{"name": "grader", "scopes": []string{"admin"}}).Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", userPath+"/tokens", token, gin.H{"name": "grader", "scopes": []string{"read:user"}, "expires_in_days": 0}).Code)
+	w := request("POST", userPath+"/tokens", token, gin.H{"name": "grader", "scopes": []string{"read:user"}, "expires_in_days": 30})
+	assert.Equal(t, http.StatusOK, w.Code)
+	created := struct {
+		TokenID uint   `json:"token_id"`
+		Token   string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &created)
+	assert.Equal(t, true, strings.HasPrefix(created.Token, views.PersonalAccessTokenPrefix))
+
+	w = request("GET", userPath, created.Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := struct {
+		Name string `json:"username"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &info)
+	assert.Equal(t, "pat", info.Name)
+	// 沒有申請的 scope 與不開放給 personal access token 的 API
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath, created.Token, gin.H{"realname": "pat"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", userPath+"/tokens", created.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", userPath+"/tokens", created.Token, gin.H{"name": "escalate", "scopes": []string{"write:user"}}).Code)
+
+	w = request("GET", userPath+"/tokens", token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	list := struct {
+		Tokens []struct {
+			Name       string   `json:"name"`
+			Scopes     []string `json:"scopes"`
+			ExpiresAt  *int64   `json:"expires_at"`
+			LastUsedAt *int64   `json:"last_used_at"`
+		} `json:"tokens"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &list)
+	assert.Equal(t, 1, len(list.Tokens))
+	assert.Equal(t, []string{"read:user"}, list.Tokens[0].Scopes)
+	assert.NotEqual(t, nil, list.Tokens[0].ExpiresAt)
+	assert.NotEqual(t, nil, list.Tokens[0].LastUsedAt)
+
+	path := userPath + "/tokens/" + strconv.FormatUint(uint64(created.TokenID), 10)
+	assert.Equal(t, http.StatusOK, request("DELETE", path, token, nil).Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", path, token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, created.Token, nil).Code)
+
+	// 改密碼或權限後，之前建立的 token 失效，之後建立的可以使用
+	create := func() string {
+		w := request("POST", userPath+"/tokens", token, gin.H{"name": "grader", "scopes": []string{"read:user"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &created)
+		return created.Token
+	}
+	old := create()
+	user, _ := models.UserDetailByUserName("pat")
+	user.TokenVersion++
+	assert.Equal(t, nil, models.UpdateUser(&user))
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, old, nil).Code)
+	token = loginAs(t, "pat", password)
+	assert.Equal(t, http.StatusOK, request("GET", userPath, create(), nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, old, nil).Code)
+}
+
+func TestPrivateAPI(t *testing.T) {
+	judgeSecret := "judge-secret-0123456789abcdefghijklmnop"
+	for key, value := range map[string]string{
+		"PRIVATE_SERVICES":                   "judge,mailer",
+		"PRIVATE_SERVICE_JUDGE_SECRET":       judgeSecret,
+		"PRIVATE_SERVICE_JUDGE_PERMISSIONS":  "username",
+		"PRIVATE_SERVICE_MAILER_SECRET":      "mailer-secret-0123456789abcdefghijklmnop",
+		"PRIVATE_SERVICE_MAILER_PERMISSIONS": "",
+	} {
+		os.Setenv(key, value)
+	}
+	views.Setup()
+
+	r := router.SetupRouter()
+	path := "/api/private/v1/username"
+	body := []byte(`{"user_id": ["` + userID + `"]}`)
+	send := func(service, secret string, timestamp time.Time, nonce string, sent []byte) *httptest.ResponseRecorder {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(sent))
+		req.Header.Set(contentType())
+		req.Header.Set("X-Service-ID", service)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", pkg.SignRequest([]byte(secret), "POST", path, ts, nonce, body))
+		r.ServeHTTP(w, req)
+		return w
+	}
+	request := func(service, secret string, timestamp time.Time, sent []byte) *httptest.ResponseRecorder {
+		nonce, _ := pkg.RandomToken(16)
+		return send(service, secret, timestamp, nonce, sent)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = request("judge", judgeSecret, time.Now(), body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		UserList []struct {
+			UserName string `json:"username"`
+		} `json:"user_list"`
+	}{}
+	data, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(data, &s)
+	assert.Equal(t, 1, len(s.UserList))
+
+	// 錯誤的金鑰、被竄改的 body、過期的時間戳記
+	assert.Equal(t, http.StatusUnauthorized, request("judge", "wrong-secret", time.Now(), body).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("judge", judgeSecret, time.Now(), []byte(`{"user_id": ["1","2","3"]}`)).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("judge", judgeSecret, time.Now().Add(-10*time.Minute), body).Code)
+	// 沒有權限的服務
+	assert.Equal(t, http.StatusForbidden, request("mailer", "mailer-secret-0123456789abcdefghijklmnop", time.Now(), body).Code)
+
+	// 同一秒內相同的請求以 nonce 區分，重送使用過的 nonce 會被拒絕
+	now := time.Now()
+	assert.Equal(t, http.StatusOK, send("judge", judgeSecret, now, "nonce-1", body).Code)
+	assert.Equal(t, http.StatusOK, send("judge", judgeSecret, now, "nonce-2", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("judge", judgeSecret, now, "nonce-1", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("judge", judgeSecret, now.Add(time.Second), "nonce-1", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("judge", judgeSecret, now, "", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, send("judge", judgeSecret, now, strings.Repeat("n", 65), body).Code)
+}
+
+func TestImpersonation(t *testing.T) {
+	student := createUser(t, "impersonated")
+	studentToken := loginAs(t, "impersonated", password)
+	adminToken := login(t)
+	r := router.SetupRouter()
+	request := func(method, path, token string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	start := gin.H{"user_id": student.ID, "reason": "page looks broken"}
+	assert.Equal(t, http.StatusForbidden, request("POST", userPath+"/impersonate", studentToken, start).Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", userPath+"/impersonate", adminToken, gin.H{"user_id": student.ID}).Code)
+	w := request("POST", userPath+"/impersonate", adminToken, start)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	claims, err := views.VerifyToken(s.Token)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, strconv.FormatUint(uint64(student.ID), 10), claims["id"])
+	admin, _ := models.UserDetailByUserName("vincent")
+	assert.Equal(t, strconv.FormatUint(uint64(admin.ID), 10), claims["impersonator"])
+
+	w = request("GET", userPath, s.Token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	info := struct {
+		Name string `json:"username"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &info)
+	assert.Equal(t, "impersonated", info.Name)
+
+	// 模擬時不能進行敏感操作，也不能換發 token
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath, s.Token, gin.H{"realname": "impersonated"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath+"/password", s.Token, gin.H{"password": "hijacked"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath+"/email", s.Token, gin.H{"email": "hijacked@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath, s.Token, gin.H{"password": "hijacked"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath, s.Token, gin.H{"email": "hijacked@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath+"/permission", s.Token, gin.H{"user_id": student.ID, "admin": true}).Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", userPath+"/totp", s.Token, nil).Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", userPath+"/tokens", s.Token, gin.H{"name": "x", "scopes": []string{"read:user"}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/api/v1/token", s.Token, nil).Code)
+
+	assert.Equal(t, http.StatusOK, request("DELETE", userPath+"/impersonate", s.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, s.Token, nil).Code)
+	assert.Equal(t, http.StatusBadRequest, request("DELETE", userPath+"/impersonate", studentToken, nil).Code)
+
+	w = request("GET", userPath+"/audit_logs?user_id="+strconv.FormatUint(uint64(student.ID), 10), adminToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	logs := struct {
+		AuditLogs []struct {
+			Action string `json:"action"`
+			Detail string `json:"detail"`
+		} `json:"audit_logs"`
+	}{}
+	body, _ = ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &logs)
+	assert.Equal(t, 2, len(logs.AuditLogs))
+	assert.Equal(t, "impersonation_stop", logs.AuditLogs[0].Action)
+	assert.Equal(t, "impersonation_start", logs.AuditLogs[1].Action)
+	assert.Equal(t, "page looks broken", logs.AuditLogs[1].Detail)
+	assert.Equal(t, http.StatusForbidden, request("GET", userPath+"/audit_logs", studentToken, nil).Code)
+}
+
+func TestSudoMode(t *testing.T) {
+	createUser(t, "sudo")
+	token := loginAs(t, "sudo", password)
+	r := router.SetupRouter()
+	request := func(method, path string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(contentType())
+		req.RemoteAddr = "198.51.100.17:4321"
+		r.ServeHTTP(w, req)
+		return w
+	}
+	createToken := gin.H{"name": "cli", "scopes": []string{"read:user"}}
+
+	// 剛登入時可以直接進行敏感操作
+	assert.Equal(t, http.StatusOK, request("POST", userPath+"/tokens", createToken).Code)
+
+	// 超過期限後需要再次驗證身分
+	claims, _ := views.VerifyToken(token)
+	models.ElevateSession(claims["sid"].(string), time.Now().Add(-time.Second))
+	w := request("POST", userPath+"/tokens", createToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	s := struct {
+		SudoRequired bool `json:"sudo_required"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &s)
+	assert.Equal(t, true, s.SudoRequired)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath+"/password", gin.H{"password": "654321"}).Code)
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath+"/email", gin.H{"email": "sudo2@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath, gin.H{"realname": "sudo"}).Code)
+	// 舊的資料更改 API 仍然可以更改密碼與 email，但同樣需要最近驗證過身分
+	w = request("PATCH", userPath, gin.H{"password": "654321"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, http.StatusForbidden, request("PATCH", userPath, gin.H{"email": "sudo2@ncnu.edu.tw"}).Code)
+
+	assert.Equal(t, http.StatusBadRequest, request("POST", userPath+"/sudo", gin.H{}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", userPath+"/sudo", gin.H{"password": "wrong"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", userPath+"/sudo", gin.H{"code": "123456"}).Code)
+	assert.Equal(t, http.StatusOK, request("POST", userPath+"/sudo", gin.H{"password": password}).Code)
+	assert.Equal(t, http.StatusOK, request("POST", userPath+"/tokens", createToken).Code)
+	assert.Equal(t, http.StatusBadRequest, request("PATCH", userPath+"/password", gin.H{}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("PATCH", userPath+"/password", gin.H{"password": "123"}).Code)
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/email", gin.H{"email": "sudo2@ncnu.edu.tw"}).Code)
+	user, _ := models.UserDetailByEmail("sudo2@ncnu.edu.tw")
+	assert.Equal(t, "sudo", user.UserName)
+	assert.Equal(t, http.StatusUnauthorized, request("PATCH", userPath, gin.H{"password": "123"}).Code)
+	assert.Equal(t, http.StatusBadRequest, request("PATCH", userPath, gin.H{"email": ""}).Code)
+
+	// 更改密碼後所有裝置都需要重新登入
+	other := loginAs(t, "sudo", password)
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/password", gin.H{"password": "654321"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, nil).Code)
+	token = other
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, nil).Code)
+	sessions, _ := models.GetSessionsByUserID(user.ID)
+	assert.Equal(t, 0, len(sessions))
+
+	token = loginAs(t, "sudo", "654321")
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath, gin.H{"password": password, "email": "sudo3@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, nil).Code)
+	user, _ = models.UserDetailByEmail("sudo3@ncnu.edu.tw")
+	assert.Equal(t, "sudo", user.UserName)
+	loginAs(t, "sudo", password)
+}
+
+func TestIntrospection(t *testing.T) {
+	secret := "judge-secret-0123456789abcdefghijklmnop"
+	os.Setenv("PRIVATE_SERVICES", "judge")
+	os.Setenv("PRIVATE_SERVICE_JUDGE_SECRET", secret)
+	os.Setenv("PRIVATE_SERVICE_JUDGE_PERMISSIONS", "introspect")
+	views.Setup()
+
+	user := createUser(t, "introspect")
+	token := loginAs(t, "introspect", password)
+	r := router.SetupRouter()
+	type result struct {
+		Active    bool   `json:"active"`
+		TokenType string `json:"token_type"`
+		ID        string `json:"id"`
+		Username  string `json:"username"`
+		Teacher   bool   `json:"teacher"`
+		Scope     string `json:"scope"`
+	}
+	introspect := func(token string) (result, *httptest.ResponseRecorder) {
+		body := []byte(url.Values{"token": {token}}.Encode())
+		path := "/api/private/v1/introspect"
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce, _ := pkg.RandomToken(16)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Service-ID", "judge")
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", pkg.SignRequest([]byte(secret), "POST", path, ts, nonce, body))
+		r.ServeHTTP(w, req)
+		var s result
+		data, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(data, &s)
+		return s, w
+	}
+
+	s, w := introspect(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, s.Active)
+	assert.Equal(t, "access_token", s.TokenType)
+	assert.Equal(t, strconv.FormatUint(uint64(user.ID), 10), s.ID)
+	assert.Equal(t, "introspect", s.Username)
+	assert.Equal(t, false, s.Teacher)
+	assert.Equal(t, "private, max-age=30", w.Header().Get("Cache-Control"))
+
+	// 回傳目前資料庫中的權限，而不是 token 中的
+	user.Teacher = true
+	models.UpdateUser(&user)
+	s, _ = introspect(token)
+	assert.Equal(t, true, s.Teacher)
+
+	data, _ := json.Marshal(gin.H{"name": "export", "scopes": []string{"read:user"}})
+	w = httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", userPath+"/tokens", bytes.NewBuffer(data))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set(contentType())
+	r.ServeHTTP(w, req)
+	created := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &created)
+	s, _ = introspect(created.Token)
+	assert.Equal(t, true, s.Active)
+	assert.Equal(t, "personal_access_token", s.TokenType)
+	assert.Equal(t, "read:user", s.Scope)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/token", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	s, w = introspect(token)
+	assert.Equal(t, false, s.Active)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	s, _ = introspect("not-a-token")
+	assert.Equal(t, false, s.Active)
+}
+
+func TestTokenVersion(t *testing.T) {
+	user := createUser(t, "demoted")
+	user.Teacher = true
+	models.UpdateUser(&user)
+	adminToken := login(t)
+	r := router.SetupRouter()
+	request := func(method, path, token string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+	loginDemoted := func() (int, string, string) {
+		w := request("POST", "/api/v1/token", "", gin.H{"username": "demoted", "password": password})
+		s := struct {
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return w.Code, s.Token, s.RefreshToken
+	}
+
+	_, token, refreshToken := loginDemoted()
+	assert.Equal(t, http.StatusOK, request("GET", userPath, token, nil).Code)
+
+	// 降級後舊的 token 與 refresh token 立即失效，重新登入取得的 token 帶有新的權限
+	permission := gin.H{"user_id": user.ID, "teacher": false}
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/permission", adminToken, permission).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/api/v1/token/refresh", "", gin.H{"refresh_token": refreshToken}).Code)
+	_, token, refreshToken = loginDemoted()
+	claims, _ := views.VerifyToken(token)
+	assert.Equal(t, false, claims["teacher"])
+	assert.Equal(t, http.StatusOK, request("GET", userPath, token, nil).Code)
+	w := request("POST", "/api/v1/token/refresh", "", gin.H{"refresh_token": refreshToken})
+	assert.Equal(t, http.StatusOK, w.Code)
+	refreshed := struct {
+		Token string `json:"token"`
+	}{}
+	body, _ := ioutil.ReadAll(w.Body)
+	json.Unmarshal(body, &refreshed)
+
+	// 沒有改變權限時不影響已簽發的 token
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/permission", adminToken, permission).Code)
+	assert.Equal(t, http.StatusOK, request("GET", userPath, refreshed.Token, nil).Code)
+
+	// 停用帳號後不能使用與換發 token，也不能登入
+	_, _, refreshToken = loginDemoted()
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/permission", adminToken, gin.H{"user_id": user.ID, "suspended": true}).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", userPath, refreshed.Token, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/api/v1/token/refresh", "", gin.H{"refresh_token": refreshToken}).Code)
+	code, _, _ := loginDemoted()
+	assert.Equal(t, http.StatusForbidden, code)
+
+	assert.Equal(t, http.StatusOK, request("PATCH", userPath+"/permission", adminToken, gin.H{"user_id": user.ID, "suspended": false}).Code)
+	code, token, _ = loginDemoted()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, request("GET", userPath, token, nil).Code)
+}
+
+func TestLoginHistory(t *testing.T) {
+	user := createUser(t, "history")
+	r := router.SetupRouter()
+	attempt := func(identifier, pwd string) int {
+		data, _ := json.Marshal(gin.H{"username": identifier, "password": pwd})
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0")
+		req.RemoteAddr = "198.51.100.20:1234"
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, attempt("history", "wrong password"))
+	assert.Equal(t, http.StatusOK, attempt("history@ncnu.edu.tw", password))
+	token := loginAs(t, "history", password)
+
+	type entry struct {
+		Identifier string `json:"identifier"`
+		Method     string `json:"method"`
+		Success    bool   `json:"success"`
+		Reason     string `json:"reason"`
+		IP         string `json:"ip"`
+		Device     string `json:"device"`
+	}
+	history := func(path, token string) (int, []entry) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		s := struct {
+			Logins []entry `json:"logins"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return w.Code, s.Logins
+	}
+
+	// 新的在前
+	code, logins := history(userPath+"/logins", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, len(logins))
+	assert.Equal(t, true, logins[0].Success)
+	assert.Equal(t, entry{
+		Identifier: "history@ncnu.edu.tw",
+		Method:     "password",
+		Success:    true,
+		IP:         "198.51.100.20",
+		Device:     "Firefox on Linux",
+	}, logins[1])
+	assert.Equal(t, false, logins[2].Success)
+	assert.Equal(t, "wrong_credentials", logins[2].Reason)
+
+	code, logins = history(userPath+"/logins?limit=1", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(logins))
+
+	// 只有管理員可以查看其他使用者的登入紀錄
+	path := userPath + "/logins?user_id=" + strconv.FormatUint(uint64(user.ID), 10)
+	code, logins = history(path, login(t))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, len(logins))
+	admin, _ := models.UserDetailByUserName("vincent")
+	code, _ = history(userPath+"/logins?user_id="+strconv.FormatUint(uint64(admin.ID), 10), token)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// 密碼正確但兩步驟驗證失敗時不算成功登入，也不會讓裝置被視為曾經登入過
+	mfaUser := createUser(t, "historymfa")
+	totpSecret, _ := pkg.GenerateTOTPSecret()
+	mfaUser.TOTPSecret, _ = pkg.EncryptTOTPSecret(totpSecret)
+	mfaUser.TOTPEnabled = true
+	models.UpdateUser(&mfaUser)
+	userAgent := "Mozilla/5.0 (X11; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0"
+	post := func(path string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		req.Header.Set("User-Agent", userAgent)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	mfa := struct {
+		MFAToken string `json:"mfa_token"`
+	}{}
+	body, _ := ioutil.ReadAll(post("/api/v1/token", gin.H{"username": "historymfa@ncnu.edu.tw", "password": password}).Body)
+	json.Unmarshal(body, &mfa)
+	totpCode, _ := pkg.TOTPCode(totpSecret, pkg.TOTPStep(time.Now()))
+	wrongCode := "000000"
+	if totpCode == wrongCode {
+		wrongCode = "111111"
+	}
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/token/totp", gin.H{"mfa_token": mfa.MFAToken, "code": wrongCode}).Code)
+	known, _ := models.HasSuccessfulLogin(mfaUser.ID, userAgent)
+	assert.Equal(t, false, known)
+
+	assert.Equal(t, http.StatusOK, post("/api/v1/token/totp", gin.H{"mfa_token": mfa.MFAToken, "code": totpCode}).Code)
+	known, _ = models.HasSuccessfulLogin(mfaUser.ID, userAgent)
+	assert.Equal(t, true, known)
+	attempts, _ := models.GetLoginAttemptsByUserID(mfaUser.ID, 10)
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, []string{"totp", "totp", "password"}, []string{attempts[0].Method, attempts[1].Method, attempts[2].Method})
+	assert.Equal(t, []bool{true, false, false}, []bool{attempts[0].Success, attempts[1].Success, attempts[2].Success})
+	assert.Equal(t, []string{"", "wrong_code", "mfa_required"}, []string{attempts[0].Reason, attempts[1].Reason, attempts[2].Reason})
+	assert.Equal(t, "historymfa@ncnu.edu.tw", attempts[2].Identifier)
+}
+
+func TestCaptchaProvider(t *testing.T) {
+	createUser(t, "captcha")
+	// 假的 Turnstile，token 為 pass 時通過，action 固定為 login
+	turnstile := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		json.NewEncoder(w).Encode(gin.H{
+			"success": r.PostForm.Get("secret") == "turnstile" && r.PostForm.Get("response") == "pass",
+			"action":  "login",
+		})
+	}))
+	defer turnstile.Close()
+	env := map[string]string{
+		"CAPTCHA_PROVIDER":   "turnstile",
+		"CAPTCHA_SECRET":     "turnstile",
+		"CAPTCHA_VERIFY_URL": turnstile.URL,
+		"CAPTCHA_ENDPOINTS":  "login",
+		// 只測試一律需要 captcha 的 API
+		"CAPTCHA_ADAPTIVE_LOGIN": "0",
+	}
+	defer setenv(env)()
+
+	r := router.SetupRouter()
+	post := func(path string, body gin.H) int {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/token", gin.H{"username": "captcha", "password": password}))
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/token", gin.H{"username": "captcha", "password": password, "captcha_token": "fail"}))
+	assert.Equal(t, http.StatusOK, post("/api/v1/token", gin.H{"username": "captcha", "password": password, "captcha_token": "pass"}))
+
+	// token 是給其他 API 的時候不能使用
+	os.Setenv("CAPTCHA_ENDPOINTS", "register")
+	views.Setup()
+	register := gin.H{
+		"username":      "captcharegister",
+		"password":      password,
+		"realname":      "captcha",
+		"email":         "captcharegister@ncnu.edu.tw",
+		"student_id":    "captcharegister",
+		"captcha_token": "pass",
+	}
+	assert.Equal(t, http.StatusBadRequest, post(userPath, register))
+	assert.Equal(t, http.StatusOK, post("/api/v1/token", gin.H{"username": "captcha", "password": password}))
+
+	// 停用 captcha 時不需要 token
+	os.Setenv("CAPTCHA_PROVIDER", "disabled")
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "test key encryption key")
+	os.Setenv("CAPTCHA_ENDPOINTS", "register,forget_password")
+	views.Setup()
+	delete(register, "captcha_token")
+	assert.Equal(t, http.StatusOK, post(userPath, register))
+	assert.Equal(t, http.StatusOK, post("/api/v1/forget_password", gin.H{"username": "captcha"}))
+}
+
+func TestProofOfWorkCaptcha(t *testing.T) {
+	createUser(t, "pow")
+	env := map[string]string{
+		"CAPTCHA_PROVIDER":       "pow",
+		"CAPTCHA_POW_DIFFICULTY": "8",
+		"CAPTCHA_ENDPOINTS":      "login",
+	}
+	defer setenv(env)()
+
+	r := router.SetupRouter()
+	challenge := func(action string) (int, string) {
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("GET", "/api/v1/captcha?action="+action, nil)
+		r.ServeHTTP(w, req)
+		s := struct {
+			Challenge  string `json:"challenge"`
+			Difficulty int    `json:"difficulty"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		if w.Code == http.StatusOK {
+			assert.Equal(t, 8, s.Difficulty)
+		}
+		return w.Code, s.Challenge
+	}
+	loginStatus := func(captchaToken string) int {
+		data, _ := json.Marshal(gin.H{"username": "pow", "password": password, "captcha_token": captchaToken})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/token", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	code, puzzle := challenge("login")
+	assert.Equal(t, http.StatusOK, code)
+	wrong := 0
+	for pkg.CheckProofOfWork(puzzle, strconv.Itoa(wrong), 8) {
+		wrong++
+	}
+	assert.Equal(t, http.StatusBadRequest, loginStatus(puzzle+":"+strconv.Itoa(wrong)))
+	solved := puzzle + ":" + pkg.SolveProofOfWork(puzzle, 8)
+	assert.Equal(t, http.StatusOK, loginStatus(solved))
+	// 解出的題目只能使用一次
+	assert.Equal(t, http.StatusBadRequest, loginStatus(solved))
+
+	// 其他 API 的題目不能用來登入
+	code, puzzle = challenge("register")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusBadRequest, loginStatus(puzzle+":"+pkg.SolveProofOfWork(puzzle, 8)))
+	code, _ = challenge("unknown")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// 提高難度後，之前較簡單的題目不再有效
+	code, puzzle = challenge("login")
+	assert.Equal(t, http.StatusOK, code)
+	os.Setenv("CAPTCHA_POW_DIFFICULTY", "9")
+	views.Setup()
+	assert.Equal(t, http.StatusBadRequest, loginStatus(puzzle+":"+pkg.SolveProofOfWork(puzzle, 8)))
+
+	os.Setenv("CAPTCHA_PROVIDER", "disabled")
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "test key encryption key")
+	views.Setup()
+	code, _ = challenge("login")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAdaptiveCaptcha(t *testing.T) {
+	createUser(t, "adaptive")
+	defer setenv(map[string]string{
+		"CAPTCHA_PROVIDER":       "pow",
+		"CAPTCHA_POW_DIFFICULTY": "4",
+	})()
+
+	r := router.SetupRouter()
+	const laptop = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36"
+	const phone = "Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1"
+	request := func(method, path, ip, userAgent string, body gin.H) (int, bool) {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		s := struct {
+			CaptchaRequired bool `json:"captcha_required"`
+		}{}
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return w.Code, s.CaptchaRequired
+	}
+	solve := func(action, ip string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/captcha?action="+action, nil)
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		s := struct {
+			Challenge string `json:"challenge"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		return s.Challenge + ":" + pkg.SolveProofOfWork(s.Challenge, 4)
+	}
+	loginWith := func(ip, userAgent, pwd, captchaToken string) (int, bool) {
+		return request("POST", "/api/v1/token", ip, userAgent, gin.H{"username": "adaptive", "password": pwd, "captcha_token": captchaToken})
+	}
+
+	// 註冊一律需要 captcha
+	register := gin.H{
+		"username":   "adaptiveregister",
+		"password":   password,
+		"realname":   "adaptive",
+		"email":      "adaptiveregister@ncnu.edu.tw",
+		"student_id": "adaptiveregister",
+	}
+	code, required := request("POST", userPath, "198.51.100.30", laptop, register)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, true, required)
+	register["captcha_token"] = solve("register", "198.51.100.30")
+	code, _ = request("POST", userPath, "198.51.100.30", laptop, register)
+	assert.Equal(t, http.StatusOK, code)
+
+	// 從沒登入成功過的裝置需要 captcha，登入成功後同一個裝置不需要
+	code, required = loginWith("198.51.100.30", laptop, password, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, true, required)
+	code, _ = loginWith("198.51.100.30", laptop, password, solve("login", "198.51.100.30"))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = loginWith("198.51.100.30", laptop, password, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, required = loginWith("198.51.100.30", phone, password, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, true, required)
+
+	// 帳號連續失敗後需要 captcha，密碼正確也一樣
+	for i := 0; i < 2; i++ {
+		code, _ = loginWith("198.51.100.30", laptop, "wrong password", "")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	code, required = loginWith("198.51.100.30", laptop, password, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, true, required)
+	code, _ = loginWith("198.51.100.30", laptop, password, solve("login", "198.51.100.30"))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = loginWith("198.51.100.30", laptop, password, "")
+	assert.Equal(t, http.StatusOK, code)
+
+	// 同一個 IP 嘗試多個帳號失敗後，從這個 IP 登入都需要 captcha
+	for i := 0; i < 5; i++ {
+		code, _ = request("POST", "/api/v1/token", "198.51.100.31", laptop, gin.H{
+			"username":      "adaptive" + strconv.Itoa(i),
+			"password":      "wrong password",
+			"captcha_token": solve("login", "198.51.100.31"),
+		})
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	code, required = loginWith("198.51.100.31", laptop, password, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, true, required)
+	code, _ = loginWith("198.51.100.30", laptop, password, "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestMagicLink(t *testing.T) {
+	createUser(t, "magic")
+	type mail struct {
+		to      string
+		message string
+	}
+	var outbox []mail
+	deliver := pkg.DeliverMail
+	defer func() { pkg.DeliverMail = deliver }()
+	pkg.DeliverMail = func(to string, message []byte) error {
+		outbox = append(outbox, mail{to, string(message)})
+		return nil
+	}
+	r := router.SetupRouter()
+	post := func(path string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// 沒有設定登入連結的網址時不提供 magic link 登入
+	assert.Equal(t, http.StatusNotFound, post("/api/v1/token/magic_link", gin.H{"email": "magic@ncnu.edu.tw"}).Code)
+	defer setenv(map[string]string{"MAGIC_LINK_URL": "https://oj.ncnu.edu.tw/login/magic_link"})()
+
+	w := httptest.NewRecorder()
+	data, _ := json.Marshal(gin.H{"email": "Magic@ncnu.edu.tw"})
+	req, _ := http.NewRequest("POST", "/api/v1/token/magic_link", bytes.NewBuffer(data))
+	req.Header.Set(contentType())
+	req.Host = "evil.example.com"
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, len(outbox))
+	assert.Equal(t, "magic@ncnu.edu.tw", outbox[0].to)
+	// 連結的網址不受請求的 Host 影響
+	start := strings.Index(outbox[0].message, "https://oj.ncnu.edu.tw/login/magic_link?token=")
+	assert.NotEqual(t, -1, start)
+	link, _ := url.Parse(strings.TrimSpace(outbox[0].message[start:]))
+	token := link.Query().Get("token")
+
+	// 同一個信箱不能連續寄送，不存在的信箱也一樣，避免判斷帳號是否存在
+	assert.Equal(t, http.StatusTooManyRequests, post("/api/v1/token/magic_link", gin.H{"email": "magic@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusOK, post("/api/v1/token/magic_link", gin.H{"email": "nobody@ncnu.edu.tw"}).Code)
+	assert.Equal(t, http.StatusTooManyRequests, post("/api/v1/token/magic_link", gin.H{"email": "nobody@ncnu.edu.tw"}).Code)
+	assert.Equal(t, 1, len(outbox))
+
+	w = post("/api/v1/token/magic_link/exchange", gin.H{"token": token})
+	assert.Equal(t, http.StatusOK, w.Code)
+	s := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &s)
+	assert.NotEqual(t, "", s.RefreshToken)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", userPath, nil)
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// 以 magic link 登入不視為最近驗證過身分
+	claims, _ := views.VerifyToken(s.Token)
+	session, _ := models.SessionBySID(claims["sid"].(string))
+	assert.Equal(t, true, session.ElevatedUntil == nil)
+
+	// 連結只能使用一次
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/token/magic_link/exchange", gin.H{"token": token}).Code)
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/token/magic_link/exchange", gin.H{"token": s.Token}).Code)
+}
+
+func TestCookieSession(t *testing.T) {
+	createUser(t, "cookie")
+	r := router.SetupRouter()
+	type request struct {
+		method, path, body, csrf, bearer string
+		cookies                          []*http.Cookie
+	}
+	send := func(q request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest(q.method, q.path, strings.NewReader(q.body))
+		req.Header.Set(contentType())
+		for _, cookie := range q.cookies {
+			req.AddCookie(cookie)
+		}
+		if q.csrf != "" {
+			req.Header.Set("X-CSRF-Token", q.csrf)
+		}
+		if q.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+q.bearer)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	cookieMap := func(w *httptest.ResponseRecorder) map[string]*http.Cookie {
+		cookies := map[string]*http.Cookie{}
+		for _, cookie := range w.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		return cookies
+	}
+	loginBody := `{"username": "cookie", "password": "` + password + `"}`
+
+	// 預設不使用 cookie
+	w := send(request{method: "POST", path: "/api/v1/token", body: loginBody})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, len(cookieMap(w)))
+
+	defer setenv(map[string]string{"COOKIE_SESSION": "1"})()
+	w = send(request{method: "POST", path: "/api/v1/token", body: loginBody})
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := cookieMap(w)
+	access, refresh, csrf := cookies["access_token"], cookies["refresh_token"], cookies["csrf_token"]
+	assert.Equal(t, true, access.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, access.SameSite)
+	assert.Equal(t, true, refresh.HttpOnly)
+	assert.Equal(t, "/api/v1/token", refresh.Path)
+	assert.Equal(t, false, csrf.HttpOnly)
+	s := struct {
+		Token string `json:"token"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &s)
+
+	// 以 cookie 驗證時，會改變狀態的請求需要 CSRF token
+	session := []*http.Cookie{access, csrf}
+	assert.Equal(t, http.StatusOK, send(request{method: "GET", path: userPath, cookies: session}).Code)
+	change := `{"realname": "cookie"}`
+	assert.Equal(t, http.StatusForbidden, send(request{method: "PATCH", path: userPath, body: change, cookies: session}).Code)
+	assert.Equal(t, http.StatusForbidden, send(request{method: "PATCH", path: userPath, body: change, cookies: session, csrf: "wrong"}).Code)
+	assert.Equal(t, http.StatusOK, send(request{method: "PATCH", path: userPath, body: change, cookies: session, csrf: csrf.Value}).Code)
+	// Authorization header 不受 CSRF 檢查影響
+	assert.Equal(t, http.StatusOK, send(request{method: "PATCH", path: userPath, body: change, bearer: s.Token}).Code)
+
+	// 以 cookie 中的 refresh token 換發
+	refreshSession := []*http.Cookie{refresh, csrf}
+	assert.Equal(t, http.StatusForbidden, send(request{method: "POST", path: "/api/v1/token/refresh", body: `{}`, cookies: refreshSession}).Code)
+	w = send(request{method: "POST", path: "/api/v1/token/refresh", cookies: refreshSession, csrf: csrf.Value})
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies = cookieMap(w)
+	assert.NotEqual(t, access.Value, cookies["access_token"].Value)
+	assert.NotEqual(t, refresh.Value, cookies["refresh_token"].Value)
+	assert.Equal(t, csrf.Value, cookies["csrf_token"].Value)
+	access, refresh = cookies["access_token"], cookies["refresh_token"]
+
+	// 登出時清除 cookie，之後 cookie 中的 token 都不能再使用
+	w = send(request{method: "DELETE", path: "/api/v1/token", cookies: []*http.Cookie{access, refresh, csrf}, csrf: csrf.Value})
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, name := range []string{"access_token", "refresh_token", "csrf_token"} {
+		assert.Equal(t, -1, cookieMap(w)[name].MaxAge)
+	}
+	assert.Equal(t, http.StatusUnauthorized, send(request{method: "GET", path: userPath, cookies: []*http.Cookie{access}}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(request{method: "POST", path: "/api/v1/token/refresh", body: `{}`, cookies: []*http.Cookie{refresh, csrf}, csrf: csrf.Value}).Code)
+}
+
+func TestGitHubLogin(t *testing.T) {
+	type githubUser struct {
+		id       int
+		login    string
+		email    string
+		verified bool
+	}
+	challenges := map[string]string{}
+	users := map[string]githubUser{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.PostFormValue("code")
+		challenge, ok := challenges[code]
+		delete(challenges, code)
+		// GitHub 換取失敗時也回傳 200
+		if r.PostFormValue("client_id") != "backend" || r.PostFormValue("client_secret") != "secret" || !ok ||
+			pkg.PKCEChallenge(r.PostFormValue("code_verifier")) != challenge {
+			json.NewEncoder(w).Encode(gin.H{"error": "bad_verification_code"})
+			return
+		}
+		json.NewEncoder(w).Encode(gin.H{"access_token": code, "token_type": "bearer"})
+	})
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		user := users[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		json.NewEncoder(w).Encode(gin.H{"id": user.id, "login": user.login, "name": nil, "email": nil})
+	})
+	mux.HandleFunc("/api/v3/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		user := users[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		json.NewEncoder(w).Encode([]gin.H{
+			{"email": user.login + "@users.noreply.github.com", "primary": false, "verified": true},
+			{"email": user.email, "primary": true, "verified": user.verified},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	defer setenv(map[string]string{
+		"OIDC_PROVIDERS":            "github",
+		"OIDC_GITHUB_TYPE":          "github",
+		"OIDC_GITHUB_ISSUER":        server.URL,
+		"OIDC_GITHUB_API_URL":       server.URL + "/api/v3",
+		"OIDC_GITHUB_CLIENT_ID":     "backend",
+		"OIDC_GITHUB_CLIENT_SECRET": "secret",
+		"OIDC_GITHUB_REDIRECT_URL":  "http://localhost/oidc/callback",
+		"OIDC_GITHUB_LINK_EMAIL":    "1",
+		"OIDC_GITHUB_AUTO_CREATE":   "1",
+	})()
+	createUser(t, "githublink")
+
+	r := router.SetupRouter()
+	githubLogin := func(user githubUser) (int, jwt.MapClaims) {
+		w := httptest.NewRecorder() // 取得 ResponseRecorder 物件
+		req, _ := http.NewRequest("GET", "/api/v1/oidc/github", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		s := struct {
+			Session          string `json:"session"`
+			AuthorizationURL string `json:"authorization_url"`
+			Token            string `json:"token"`
+		}{}
+		body, _ := ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		assert.Equal(t, true, strings.HasPrefix(s.AuthorizationURL, server.URL+"/login/oauth/authorize?"))
+
+		u, _ := url.Parse(s.AuthorizationURL)
+		code, _ := pkg.RandomToken(16)
+		challenges[code] = u.Query().Get("code_challenge")
+		users[code] = user
+		data, _ := json.Marshal(gin.H{"session": s.Session, "code": code, "state": u.Query().Get("state")})
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("POST", "/api/v1/token/oidc", bytes.NewBuffer(data))
+		req.Header.Set(contentType())
+		r.ServeHTTP(w, req)
+		body, _ = ioutil.ReadAll(w.Body)
+		json.Unmarshal(body, &s)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		claims, err := views.VerifyToken(s.Token)
+		assert.Equal(t, nil, err)
+		return w.Code, claims
+	}
+
+	// 已驗證的主要 email 綁定到既有帳號
+	status, claims := githubLogin(githubUser{id: 1001, login: "octocat", email: "githublink@ncnu.edu.tw", verified: true})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "githublink", claims["username"])
+
+	// 以數字 id 找到帳號，改名後仍然是同一個帳號
+	status, claims = githubLogin(githubUser{id: 1001, login: "renamed"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "githublink", claims["username"])
+
+	// 未驗證的 email 不會綁定，而是以 login 建立新帳號
+	status, claims = githubLogin(githubUser{id: 1002, login: "git-hubber", email: "githublink@ncnu.edu.tw"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "githubber", claims["username"])
+	user, err := models.UserDetailByUserName("githubber")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", user.Email)
+}
+
 func TestCleanup(t *testing.T) {
 	e := os.Remove("test.db")
 	if e != nil {
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// AuditLog 管理員操作的稽核紀錄
+type AuditLog struct {
+	gorm.Model
+	ActorID  uint   `gorm:"index; NOT NULL;"`
+	TargetID uint   `gorm:"index; NOT NULL;"`
+	Action   string `gorm:"type:varchar(50); index; NOT NULL;"`
+	Detail   string `gorm:"type:text;"`
+	IP       string `gorm:"type:varchar(45);"`
+}
+
+// CreateAuditLog 新增稽核紀錄
+func CreateAuditLog(log *AuditLog) (err error) {
+	err = DB.Create(&log).Error
+	return
+}
+
+// GetAuditLogs 取得稽核紀錄，新的在前，userID 不為 0 時只取得與該使用者有關的紀錄
+func GetAuditLogs(userID uint, limit int) (logs []AuditLog, err error) {
+	query := DB.Order("id desc").Limit(limit)
+	if userID != 0 {
+		query = query.Where("actor_id = ? OR target_id = ?", userID, userID)
+	}
+	err = query.Find(&logs).Error
+	return
+}
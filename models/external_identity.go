@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ExternalIdentity 使用者在外部 OpenID Connect provider 的帳號
+type ExternalIdentity struct {
+	gorm.Model
+	UserID     uint   `gorm:"index; NOT NULL;"`
+	User       User   `gorm:"foreignkey:UserID"`
+	Provider   string `gorm:"type:varchar(30); uniqueIndex:idx_provider_subject; NOT NULL;"`
+	Subject    string `gorm:"type:varchar(255); uniqueIndex:idx_provider_subject; NOT NULL;"`
+	Email      string `gorm:"type:varchar(255);"`
+	LastUsedAt *time.Time
+}
+
+// CreateExternalIdentity 綁定外部帳號
+func CreateExternalIdentity(identity *ExternalIdentity) (err error) {
+	err = DB.Omit("User").Create(&identity).Error
+	return
+}
+
+// CreateUserWithExternalIdentity 以外部帳號建立新的 user
+func CreateUserWithExternalIdentity(user *User, identity *ExternalIdentity) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Omit("User").Create(identity).Error
+	})
+}
+
+// UpdateExternalIdentity 更新外部帳號
+func UpdateExternalIdentity(identity *ExternalIdentity) (err error) {
+	err = DB.Omit("User").Save(&identity).Error
+	return
+}
+
+// ExternalIdentityByProviderSubject 透過 provider 與 subject 取得外部帳號
+func ExternalIdentityByProviderSubject(provider, subject string) (identity ExternalIdentity, err error) {
+	err = DB.Preload("User").Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	return
+}
+
+// GetExternalIdentitiesByUserID 取得使用者綁定的所有外部帳號
+func GetExternalIdentitiesByUserID(userID uint) (identities []ExternalIdentity, err error) {
+	err = DB.Where("user_id = ?", userID).Find(&identities).Error
+	return
+}
+
+// DeleteExternalIdentity 解除使用者綁定的外部帳號
+func DeleteExternalIdentity(userID, id uint) (deleted bool, err error) {
+	result := DB.Unscoped().Where("user_id = ?", userID).Delete(&ExternalIdentity{}, id)
+	err = result.Error
+	deleted = result.RowsAffected == 1
+	return
+}
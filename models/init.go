@@ -48,10 +48,35 @@ func Setup() {
 	AutoMigrateAll()
 }
 
-//AutoMigrateAll 自動產生 table
+//AutoMigrateAll 自動產生 table，失敗時直接結束，避免在缺少索引的資料庫上執行
 func AutoMigrateAll() {
-	DB.AutoMigrate(&User{})
-	DB.AutoMigrate(&Announcement{})
+	err := DB.AutoMigrate(
+		&User{},
+		&Announcement{},
+		&RevokedToken{},
+		&RefreshToken{},
+		&SigningKey{},
+		&RecoveryCode{},
+		&TrustedDevice{},
+		&WebAuthnCredential{},
+		&ExternalIdentity{},
+		&OAuthClient{},
+		&OAuthConsent{},
+		&OAuthAuthorizationCode{},
+		&LoginThrottle{},
+		&Session{},
+		&PersonalAccessToken{},
+		&AuditLog{},
+		&LoginAttempt{},
+		&ServiceNonce{},
+	)
+	if err != nil {
+		log.Fatal("auto migrate: ", err)
+	}
+	// 已經有只差在大小寫的重複資料時無法建立索引，需要先手動合併帳號
+	if err := migrateUserIndexes(); err != nil {
+		log.Fatal("migrate user indexes: ", err)
+	}
 }
 
 //Ping ping a database
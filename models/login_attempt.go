@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginAttempt 一次登入嘗試的紀錄，用來調查帳號共用
+type LoginAttempt struct {
+	gorm.Model
+	// 帳號不存在時為 0
+	UserID     uint   `gorm:"index; NOT NULL;"`
+	Identifier string `gorm:"type:varchar(100); NOT NULL;"`
+	Method     string `gorm:"type:varchar(20); NOT NULL;"`
+	Success    bool   `gorm:"NOT NULL;"`
+	// 失敗原因，例如 wrong_credentials、throttled，還需要兩步驟驗證時為 mfa_required
+	Reason    string `gorm:"type:varchar(50);"`
+	IP        string `gorm:"type:varchar(45); index;"`
+	UserAgent string `gorm:"type:text;"`
+}
+
+// CreateLoginAttempt 新增登入紀錄，順便清除 before 之前的紀錄
+func CreateLoginAttempt(attempt *LoginAttempt, before time.Time) (err error) {
+	if err = DB.Create(&attempt).Error; err != nil {
+		return
+	}
+	err = DB.Unscoped().Where("created_at < ?", before).Delete(&LoginAttempt{}).Error
+	return
+}
+
+// GetLoginAttemptsByUserID 取得使用者的登入紀錄，新的在前
+func GetLoginAttemptsByUserID(userID uint, limit int) (attempts []LoginAttempt, err error) {
+	err = DB.Where("user_id = ?", userID).Order("id desc").Limit(limit).Find(&attempts).Error
+	return
+}
+
+// HasSuccessfulLogin 使用者是否曾經以這個 User-Agent 登入成功
+func HasSuccessfulLogin(userID uint, userAgent string) (bool, error) {
+	var count int64
+	err := DB.Model(&LoginAttempt{}).
+		Where("user_id = ? AND success = ? AND user_agent = ?", userID, true, userAgent).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// LoginThrottle 帳號或 IP 登入失敗的次數與鎖定期限
+type LoginThrottle struct {
+	gorm.Model
+	// 例如 user:vincent、ip:127.0.0.1
+	Target        string    `gorm:"type:varchar(100); uniqueIndex; NOT NULL;"`
+	Failures      int       `gorm:"default:0; NOT NULL;"`
+	LastFailureAt time.Time `gorm:"NOT NULL;"`
+	LockedUntil   time.Time `gorm:"NOT NULL;"`
+}
+
+// LoginThrottleByTarget 取得帳號或 IP 的登入失敗紀錄
+func LoginThrottleByTarget(target string) (throttle LoginThrottle, err error) {
+	err = DB.Where("target = ?", target).First(&throttle).Error
+	return
+}
+
+// RecordLoginFailure 增加登入失敗次數，上次失敗在 since 之前時重新計算，回傳更新後的紀錄
+func RecordLoginFailure(target string, since time.Time) (throttle LoginThrottle, err error) {
+	now := time.Now()
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&LoginThrottle{}).Where("target = ?", target).Updates(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END", since),
+			"last_failure_at": now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			throttle = LoginThrottle{Target: target, Failures: 1, LastFailureAt: now}
+			return tx.Create(&throttle).Error
+		}
+		return tx.Where("target = ?", target).First(&throttle).Error
+	})
+	return
+}
+
+// LockLoginThrottle 設定鎖定期限
+func LockLoginThrottle(target string, until time.Time) error {
+	return DB.Model(&LoginThrottle{}).Where("target = ?", target).Update("locked_until", until).Error
+}
+
+// ResetLoginThrottle 清除帳號或 IP 的失敗紀錄，順便清除已經過期的紀錄
+func ResetLoginThrottle(target string, since time.Time) (deleted bool, err error) {
+	result := DB.Unscoped().Where("target = ?", target).Delete(&LoginThrottle{})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	deleted = result.RowsAffected > 0
+	err = DB.Unscoped().Where("last_failure_at < ? AND locked_until < ?", since, time.Now()).Delete(&LoginThrottle{}).Error
+	return
+}
+
+// GetLockedLoginThrottles 取得目前被鎖定的帳號與 IP
+func GetLockedLoginThrottles() (throttles []LoginThrottle, err error) {
+	err = DB.Where("locked_until > ?", time.Now()).Order("locked_until desc").Find(&throttles).Error
+	return
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// OAuthAuthorizationCode 簽發給 client 的 authorization code，只能使用一次
+type OAuthAuthorizationCode struct {
+	gorm.Model
+	CodeHash      string    `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	ClientID      string    `gorm:"type:varchar(64); index; NOT NULL;"`
+	UserID        uint      `gorm:"NOT NULL;"`
+	RedirectURI   string    `gorm:"type:text; NOT NULL;"`
+	Scope         string    `gorm:"type:text; NOT NULL;"`
+	Nonce         string    `gorm:"type:text;"`
+	CodeChallenge string    `gorm:"type:varchar(128);"`
+	AuthTime      time.Time `gorm:"NOT NULL;"`
+	ExpiresAt     time.Time `gorm:"NOT NULL;"`
+}
+
+// CreateOAuthAuthorizationCode 新增 authorization code，順便清除已過期的 code
+func CreateOAuthAuthorizationCode(code *OAuthAuthorizationCode) error {
+	if err := DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&OAuthAuthorizationCode{}).Error; err != nil {
+		return err
+	}
+	return DB.Create(&code).Error
+}
+
+// ConsumeOAuthAuthorizationCode 取出並刪除尚未過期的 authorization code
+func ConsumeOAuthAuthorizationCode(hash string) (code OAuthAuthorizationCode, err error) {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("code_hash = ? AND expires_at > ?", hash, time.Now()).First(&code).Error; err != nil {
+			return err
+		}
+		result := tx.Unscoped().Delete(&OAuthAuthorizationCode{}, code.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		// 同時有兩個請求使用同一個 code 時只有一個成功
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	return
+}
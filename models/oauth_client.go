@@ -0,0 +1,50 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// OAuthClient 透過本服務登入的外部工具
+type OAuthClient struct {
+	gorm.Model
+	ClientID string `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	// public client（例如單頁應用程式）沒有 secret
+	SecretHash   string `gorm:"type:varchar(64);"`
+	Name         string `gorm:"type:varchar(50); NOT NULL;"`
+	RedirectURIs string `gorm:"type:text; NOT NULL;"`
+	OwnerID      uint   `gorm:"index; NOT NULL;"`
+}
+
+// CreateOAuthClient 註冊 client
+func CreateOAuthClient(client *OAuthClient) (err error) {
+	err = DB.Create(&client).Error
+	return
+}
+
+// OAuthClientByClientID 透過 client id 取得 client
+func OAuthClientByClientID(clientID string) (client OAuthClient, err error) {
+	err = DB.Where("client_id = ?", clientID).First(&client).Error
+	return
+}
+
+// GetAllOAuthClients 取得所有 client
+func GetAllOAuthClients() (clients []OAuthClient, err error) {
+	err = DB.Order("id").Find(&clients).Error
+	return
+}
+
+// DeleteOAuthClient 刪除 client 以及使用者對它的授權
+func DeleteOAuthClient(clientID string) (deleted bool, err error) {
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("client_id = ?", clientID).Delete(&OAuthClient{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected == 1
+		if err := tx.Unscoped().Where("client_id = ?", clientID).Delete(&OAuthConsent{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("client_id = ?", clientID).Delete(&OAuthAuthorizationCode{}).Error
+	})
+	return
+}
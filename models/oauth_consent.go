@@ -0,0 +1,44 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// OAuthConsent 使用者同意 client 取得的 scope，同意過就不需要再詢問
+type OAuthConsent struct {
+	gorm.Model
+	UserID   uint   `gorm:"uniqueIndex:idx_user_client; NOT NULL;"`
+	ClientID string `gorm:"type:varchar(64); uniqueIndex:idx_user_client; NOT NULL;"`
+	Scope    string `gorm:"type:text; NOT NULL;"`
+}
+
+// SaveOAuthConsent 新增或更新使用者的授權
+func SaveOAuthConsent(userID uint, clientID, scope string) error {
+	var consent OAuthConsent
+	err := DB.Where(OAuthConsent{UserID: userID, ClientID: clientID}).FirstOrInit(&consent).Error
+	if err != nil {
+		return err
+	}
+	consent.Scope = scope
+	return DB.Save(&consent).Error
+}
+
+// OAuthConsentByUserClient 取得使用者對 client 的授權
+func OAuthConsentByUserClient(userID uint, clientID string) (consent OAuthConsent, err error) {
+	err = DB.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error
+	return
+}
+
+// GetOAuthConsentsByUserID 取得使用者所有的授權
+func GetOAuthConsentsByUserID(userID uint) (consents []OAuthConsent, err error) {
+	err = DB.Where("user_id = ?", userID).Find(&consents).Error
+	return
+}
+
+// DeleteOAuthConsent 撤銷使用者對 client 的授權
+func DeleteOAuthConsent(userID uint, clientID string) (deleted bool, err error) {
+	result := DB.Unscoped().Where("user_id = ? AND client_id = ?", userID, clientID).Delete(&OAuthConsent{})
+	err = result.Error
+	deleted = result.RowsAffected > 0
+	return
+}
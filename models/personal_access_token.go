@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PersonalAccessToken 給腳本與 CLI 使用的長效 token，只保存雜湊值
+type PersonalAccessToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"index; NOT NULL;"`
+	User       User   `gorm:"foreignkey:UserID"`
+	Name       string `gorm:"type:varchar(50); NOT NULL;"`
+	TokenHash  string `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	Scopes     string `gorm:"type:varchar(255); NOT NULL;"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	// 建立時使用者的 TokenVersion，使用者改密碼或權限後 token 失效
+	TokenVersion uint `gorm:"default:0; NOT NULL;"`
+}
+
+// CreatePersonalAccessToken 新增 personal access token
+func CreatePersonalAccessToken(token *PersonalAccessToken) (err error) {
+	err = DB.Create(&token).Error
+	return
+}
+
+// PersonalAccessTokenByHash 透過雜湊值取得尚未過期的 personal access token
+func PersonalAccessTokenByHash(hash string) (token PersonalAccessToken, err error) {
+	err = DB.Preload("User").
+		Where("token_hash = ? AND (expires_at IS NULL OR expires_at > ?)", hash, time.Now()).
+		First(&token).Error
+	return
+}
+
+// TouchPersonalAccessToken 更新 personal access token 最後使用的時間
+func TouchPersonalAccessToken(id uint, lastUsedAt time.Time) error {
+	return DB.Model(&PersonalAccessToken{}).Where("id = ?", id).Update("last_used_at", lastUsedAt).Error
+}
+
+// GetPersonalAccessTokensByUserID 取得使用者所有的 personal access token
+func GetPersonalAccessTokensByUserID(userID uint) (tokens []PersonalAccessToken, err error) {
+	err = DB.Where("user_id = ?", userID).Find(&tokens).Error
+	return
+}
+
+// DeletePersonalAccessToken 撤銷使用者的 personal access token
+func DeletePersonalAccessToken(userID, id uint) (deleted bool, err error) {
+	result := DB.Unscoped().Where("user_id = ?", userID).Delete(&PersonalAccessToken{}, id)
+	err = result.Error
+	deleted = result.RowsAffected == 1
+	return
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RecoveryCode 兩步驟驗證的備用碼，只保存雜湊值，每組只能使用一次
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"index; NOT NULL;"`
+	CodeHash string `gorm:"type:varchar(64); NOT NULL;"`
+	UsedAt   *time.Time
+}
+
+// ReplaceRecoveryCodes 以新的備用碼取代使用者所有的備用碼
+func ReplaceRecoveryCodes(userID uint, hashes []string) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := tx.Create(&RecoveryCode{UserID: userID, CodeHash: hash}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UseRecoveryCode 使用備用碼，回傳是否為尚未使用過的備用碼
+func UseRecoveryCode(userID uint, hash string) (used bool, err error) {
+	result := DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", time.Now())
+	err = result.Error
+	used = result.RowsAffected == 1
+	return
+}
+
+// CountUnusedRecoveryCodes 剩餘可用的備用碼數量
+func CountUnusedRecoveryCodes(userID uint) (count int64, err error) {
+	err = DB.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return
+}
+
+// DeleteRecoveryCodes 刪除使用者所有的備用碼
+func DeleteRecoveryCodes(userID uint) error {
+	return DB.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
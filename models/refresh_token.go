@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RefreshToken 長效的 refresh token，只保存雜湊值
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint      `gorm:"index; NOT NULL;"`
+	User      User      `gorm:"foreignkey:UserID"`
+	Family    string    `gorm:"type:varchar(64); index; NOT NULL;"`
+	TokenHash string    `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	ExpiresAt time.Time `gorm:"NOT NULL;"`
+	Rotated   bool      `gorm:"default:false; NOT NULL;"`
+	Revoked   bool      `gorm:"default:false; NOT NULL;"`
+	// 簽發 family 時使用者的 token version，之後權限變更或重設密碼時整個 family 失效
+	TokenVersion uint `gorm:"default:0; NOT NULL;"`
+}
+
+// CreateRefreshToken 新增 refresh token
+func CreateRefreshToken(token *RefreshToken) (err error) {
+	err = DB.Create(&token).Error
+	return
+}
+
+// RotateRefreshToken 將 refresh token 標記為已輪替，回傳是否由這次呼叫完成標記
+func RotateRefreshToken(token *RefreshToken) (rotated bool, err error) {
+	result := DB.Model(&RefreshToken{}).
+		Where("id = ? AND rotated = ?", token.ID, false).
+		Update("rotated", true)
+	err = result.Error
+	rotated = result.RowsAffected == 1
+	return
+}
+
+// RefreshTokenByHash 透過雜湊值取得 refresh token
+func RefreshTokenByHash(hash string) (token RefreshToken, err error) {
+	err = DB.Preload("User").Where("token_hash = ?", hash).First(&token).Error
+	return
+}
+
+// RevokeRefreshTokenFamily 撤銷同一個 family 的所有 refresh token
+func RevokeRefreshTokenFamily(family string) error {
+	return DB.Model(&RefreshToken{}).Where("family = ?", family).Update("revoked", true).Error
+}
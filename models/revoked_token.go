@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// RevokedToken 已撤銷的 token
+type RevokedToken struct {
+	gorm.Model
+	JTI       string    `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	UserID    uint      `gorm:"index; NOT NULL;"`
+	ExpiresAt time.Time `gorm:"index; NOT NULL;"`
+}
+
+// RevokeToken 撤銷 token，並順便清除已過期的紀錄
+func RevokeToken(token *RevokedToken) (err error) {
+	if err = DB.Create(&token).Error; err != nil {
+		return
+	}
+	err = CleanupRevokedTokens()
+	return
+}
+
+// IsTokenRevoked 檢查 token 是否已撤銷
+func IsTokenRevoked(jti string) (revoked bool, err error) {
+	var count int64
+	err = DB.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	revoked = count > 0
+	return
+}
+
+// CleanupRevokedTokens 刪除已過期的撤銷紀錄，過期的 token 本來就無法使用
+func CleanupRevokedTokens() error {
+	return DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error
+}
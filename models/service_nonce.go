@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ServiceNonce 服務呼叫 private API 時使用過的 nonce，在時間戳記的有效範圍內不能重複使用
+type ServiceNonce struct {
+	gorm.Model
+	Service   string    `gorm:"type:varchar(50); uniqueIndex:idx_service_nonces_service_nonce; NOT NULL;"`
+	Nonce     string    `gorm:"type:varchar(64); uniqueIndex:idx_service_nonces_service_nonce; NOT NULL;"`
+	ExpiresAt time.Time `gorm:"index; NOT NULL;"`
+}
+
+// UseServiceNonce 記錄使用過的 nonce，已經使用過時 used 為 true
+func UseServiceNonce(nonce *ServiceNonce) (used bool, err error) {
+	result := DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&nonce)
+	return result.RowsAffected == 0, result.Error
+}
+
+// CleanupServiceNonces 刪除已過期的 nonce，過期的請求本來就會因為時間戳記被拒絕
+func CleanupServiceNonces() error {
+	return DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&ServiceNonce{}).Error
+}
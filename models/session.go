@@ -0,0 +1,73 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session 一次登入，SID 與 refresh token 的 family 相同，撤銷時直接刪除
+type Session struct {
+	gorm.Model
+	UserID     uint      `gorm:"index; NOT NULL;"`
+	SID        string    `gorm:"column:sid; type:varchar(64); uniqueIndex; NOT NULL;"`
+	Device     string    `gorm:"type:varchar(50);"`
+	IP         string    `gorm:"type:varchar(45);"`
+	UserAgent  string    `gorm:"type:text;"`
+	LastUsedAt time.Time `gorm:"NOT NULL;"`
+	ExpiresAt  time.Time `gorm:"index; NOT NULL;"`
+	// 最近一次驗證身分後，可以進行敏感操作的期限
+	ElevatedUntil *time.Time
+}
+
+// CreateSession 新增登入的 session，順便清除已過期的紀錄
+func CreateSession(session *Session) (err error) {
+	if err = DB.Create(&session).Error; err != nil {
+		return
+	}
+	err = DB.Unscoped().Where("expires_at < ?", time.Now()).Delete(&Session{}).Error
+	return
+}
+
+// SessionBySID 透過 SID 取得尚未過期的 session
+func SessionBySID(sid string) (session Session, err error) {
+	err = DB.Where("sid = ? AND expires_at > ?", sid, time.Now()).First(&session).Error
+	return
+}
+
+// UpdateSession 更新 session
+func UpdateSession(session *Session) (err error) {
+	err = DB.Save(&session).Error
+	return
+}
+
+// TouchSession 更新 session 最後使用的時間
+func TouchSession(sid string, lastUsedAt time.Time) error {
+	return DB.Model(&Session{}).Where("sid = ?", sid).Update("last_used_at", lastUsedAt).Error
+}
+
+// ElevateSession 設定 session 可以進行敏感操作的期限
+func ElevateSession(sid string, until time.Time) error {
+	return DB.Model(&Session{}).Where("sid = ?", sid).Update("elevated_until", until).Error
+}
+
+// GetSessionsByUserID 取得使用者尚未過期的 session，最近使用的在前
+func GetSessionsByUserID(userID uint) (sessions []Session, err error) {
+	err = DB.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at desc").
+		Find(&sessions).Error
+	return
+}
+
+// DeleteSessions 刪除使用者的 session
+func DeleteSessions(userID uint, sessions []Session) (err error) {
+	if len(sessions) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(sessions))
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	err = DB.Unscoped().Where("user_id = ? AND id IN ?", userID, ids).Delete(&Session{}).Error
+	return
+}
@@ -0,0 +1,60 @@
+package models
+
+import "gorm.io/gorm"
+
+// SigningKey 狀態
+const (
+	// SigningKeyStatusSigning 用來簽署新的 token，同時只會有一把
+	SigningKeyStatusSigning = "signing"
+	// SigningKeyStatusVerify 只用來驗證已簽發的 token
+	SigningKeyStatusVerify = "verify"
+	// SigningKeyStatusRetired 已停用，用這把金鑰簽署的 token 全部失效
+	SigningKeyStatusRetired = "retired"
+)
+
+// SigningKey JWT 金鑰
+type SigningKey struct {
+	gorm.Model
+	KID        string `gorm:"column:kid; type:varchar(64); uniqueIndex; NOT NULL;"`
+	Algorithm  string `gorm:"type:varchar(10); NOT NULL;"`
+	PrivateKey string `gorm:"type:text;"`
+	Status     string `gorm:"type:varchar(10); NOT NULL;"`
+}
+
+// CreateSigningKey 新增金鑰
+func CreateSigningKey(key *SigningKey) (err error) {
+	err = DB.Create(&key).Error
+	return
+}
+
+// UpdateSigningKey 更新金鑰
+func UpdateSigningKey(key *SigningKey) (err error) {
+	err = DB.Save(&key).Error
+	return
+}
+
+// GetAllSigningKeys 取得所有金鑰
+func GetAllSigningKeys() (keys []SigningKey, err error) {
+	err = DB.Order("id").Find(&keys).Error
+	return
+}
+
+// SigningKeyByKID 透過 kid 取得金鑰
+func SigningKeyByKID(kid string) (key SigningKey, err error) {
+	err = DB.Where("kid = ?", kid).First(&key).Error
+	return
+}
+
+// PromoteSigningKey 將金鑰設為簽署用，原本的簽署金鑰改為只用來驗證
+func PromoteSigningKey(key *SigningKey) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&SigningKey{}).
+			Where("status = ?", SigningKeyStatusSigning).
+			Update("status", SigningKeyStatusVerify).Error
+		if err != nil {
+			return err
+		}
+		key.Status = SigningKeyStatusSigning
+		return tx.Save(key).Error
+	})
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TrustedDevice 在期限內登入不需要輸入兩步驟驗證碼的瀏覽器
+type TrustedDevice struct {
+	gorm.Model
+	UserID    uint      `gorm:"index; NOT NULL;"`
+	TokenHash string    `gorm:"type:varchar(64); uniqueIndex; NOT NULL;"`
+	UserAgent string    `gorm:"type:text;"`
+	ExpiresAt time.Time `gorm:"NOT NULL;"`
+}
+
+// CreateTrustedDevice 新增信任的裝置
+func CreateTrustedDevice(device *TrustedDevice) (err error) {
+	err = DB.Create(&device).Error
+	return
+}
+
+// IsTrustedDevice 檢查裝置是否仍在信任期限內
+func IsTrustedDevice(userID uint, hash string) (trusted bool, err error) {
+	var count int64
+	err = DB.Model(&TrustedDevice{}).
+		Where("user_id = ? AND token_hash = ? AND expires_at > ?", userID, hash, time.Now()).
+		Count(&count).Error
+	trusted = count > 0
+	return
+}
+
+// DeleteTrustedDevices 刪除使用者所有信任的裝置，順便清除已過期的紀錄
+func DeleteTrustedDevices(userID uint) error {
+	return DB.Unscoped().Where("user_id = ? OR expires_at < ?", userID, time.Now()).Delete(&TrustedDevice{}).Error
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -19,6 +21,68 @@ type User struct {
 	Teacher           bool      `gorm:"default:false; NOT NULL;"`
 	VerifyToken       string    `gorm:"default:NULL;"`
 	VerifyTokenExpire time.Time `gorm:"default:NULL;"`
+	TOTPSecret        string    `gorm:"type:varchar(128);"`
+	TOTPEnabled       bool      `gorm:"default:false; NOT NULL;"`
+	TOTPLastStep      int64     `gorm:"default:0; NOT NULL;"`
+	AuthBackend       string    `gorm:"type:varchar(20);"`
+	Suspended         bool      `gorm:"default:false; NOT NULL;"`
+	TokenVersion      uint      `gorm:"default:0; NOT NULL;"`
+}
+
+// 登入以 lower() 查詢 email 與學號，唯一索引也要不分大小寫，避免建立只差在大小寫的帳號
+var userUniqueIndexes = []struct {
+	Name   string
+	Column string
+}{
+	{"idx_users_lower_email", "email"},
+	{"idx_users_lower_student_id", "student_id"},
+}
+
+// duplicateUserIdentifiers 找出只差在大小寫的 email 或學號，包含已刪除的使用者
+func duplicateUserIdentifiers(column string) (values []string, err error) {
+	err = DB.Unscoped().Model(&User{}).
+		Where(column+" <> ''").
+		Group("lower("+column+")").
+		Having("count(*) > 1").
+		Pluck("lower("+column+")", &values).Error
+	return
+}
+
+// migrateUserIndexes 建立不分大小寫的唯一索引，並移除舊的分大小寫索引，
+// 建立前先檢查重複的資料，有重複時回傳需要手動合併的值
+func migrateUserIndexes() error {
+	for _, name := range []string{"idx_users_email", "idx_users_student_id"} {
+		if DB.Migrator().HasIndex(&User{}, name) {
+			if err := DB.Migrator().DropIndex(&User{}, name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, index := range userUniqueIndexes {
+		if DB.Migrator().HasIndex(&User{}, index.Name) {
+			continue
+		}
+		duplicates, err := duplicateUserIdentifiers(index.Column)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 {
+			return fmt.Errorf("users with the same %s ignoring case must be merged or changed before migrating: %s",
+				index.Column, strings.Join(duplicates, ", "))
+		}
+		statement := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON users (lower(%s)) WHERE %s <> ''",
+			index.Name, index.Column, index.Column)
+		if err := DB.Exec(statement).Error; err != nil {
+			return fmt.Errorf("create index %s: %w", index.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetUsersWithTOTPSecret 取得有兩步驟驗證密鑰的使用者
+func GetUsersWithTOTPSecret() (users []User, err error) {
+	err = DB.Where("totp_secret <> ''").Find(&users).Error
+	return
 }
 
 // UserWithUserNameAndID 取得 id 與 username
@@ -56,3 +120,21 @@ func UserDetailByUserName(name string) (user User, err error) {
 	err = DB.Where("user_name = ?", name).First(&user).Error
 	return
 }
+
+// UserDetailByEmail 透過 email 取得 user，不分大小寫
+func UserDetailByEmail(email string) (user User, err error) {
+	err = DB.Where("lower(email) = lower(?)", email).First(&user).Error
+	return
+}
+
+// UserDetailByUserNameFold 透過 username 取得 user，不分大小寫，用來與學號比對
+func UserDetailByUserNameFold(name string) (user User, err error) {
+	err = DB.Where("lower(user_name) = lower(?)", name).First(&user).Error
+	return
+}
+
+// UserDetailByStudentID 透過學號取得 user，不分大小寫
+func UserDetailByStudentID(studentID string) (user User, err error) {
+	err = DB.Where("lower(student_id) = lower(?)", studentID).First(&user).Error
+	return
+}
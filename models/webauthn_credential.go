@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential 使用者註冊的 passkey
+type WebAuthnCredential struct {
+	gorm.Model
+	UserID       uint   `gorm:"index; NOT NULL;"`
+	User         User   `gorm:"foreignkey:UserID"`
+	Name         string `gorm:"type:varchar(50); NOT NULL;"`
+	CredentialID string `gorm:"type:varchar(255); uniqueIndex; NOT NULL;"`
+	PublicKey    []byte `gorm:"NOT NULL;"`
+	Algorithm    int    `gorm:"NOT NULL;"`
+	SignCount    uint32 `gorm:"default:0; NOT NULL;"`
+	LastUsedAt   *time.Time
+}
+
+// CreateWebAuthnCredential 新增 passkey
+func CreateWebAuthnCredential(credential *WebAuthnCredential) (err error) {
+	err = DB.Create(&credential).Error
+	return
+}
+
+// UpdateWebAuthnCredential 更新 passkey
+func UpdateWebAuthnCredential(credential *WebAuthnCredential) (err error) {
+	err = DB.Omit("User").Save(&credential).Error
+	return
+}
+
+// WebAuthnCredentialByCredentialID 透過 credential id 取得 passkey
+func WebAuthnCredentialByCredentialID(credentialID string) (credential WebAuthnCredential, err error) {
+	err = DB.Preload("User").Where("credential_id = ?", credentialID).First(&credential).Error
+	return
+}
+
+// GetWebAuthnCredentialsByUserID 取得使用者所有的 passkey
+func GetWebAuthnCredentialsByUserID(userID uint) (credentials []WebAuthnCredential, err error) {
+	err = DB.Where("user_id = ?", userID).Find(&credentials).Error
+	return
+}
+
+// DeleteWebAuthnCredential 刪除使用者的 passkey
+func DeleteWebAuthnCredential(userID, id uint) (deleted bool, err error) {
+	result := DB.Where("user_id = ?", userID).Delete(&WebAuthnCredential{}, id)
+	err = result.Error
+	deleted = result.RowsAffected == 1
+	return
+}
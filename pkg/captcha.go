@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// 各家 captcha 驗證 token 的 API
+const (
+	HCaptchaVerifyURL  = "https://hcaptcha.com/siteverify"
+	ReCAPTCHAVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// Captcha 以 siteverify API 驗證 captcha token，hCaptcha、reCAPTCHA 與 Turnstile 的格式相同
+type Captcha struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// CaptchaResponse siteverify API 的回應，Score 只有 reCAPTCHA v3 有，Action 只有 reCAPTCHA v3 與 Turnstile 有
+type CaptchaResponse struct {
+	Success    bool     `json:"success"`
+	Score      float64  `json:"score"`
+	Action     string   `json:"action"`
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (c *Captcha) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// Verify 驗證前端取得的 token，remoteIP 可以是空字串
+func (c *Captcha) Verify(response, remoteIP string) (*CaptchaResponse, error) {
+	values := url.Values{"secret": {c.Secret}, "response": {response}}
+	if remoteIP != "" {
+		values.Set("remoteip", remoteIP)
+	}
+	resp, err := c.client().PostForm(c.URL, values)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("captcha: %s returned %d", c.URL, resp.StatusCode)
+	}
+	var result CaptchaResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCaptchaVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("secret") != "secret" || r.PostForm.Get("remoteip") != "192.0.2.1" {
+			t.Errorf("unexpected form %v", r.PostForm)
+		}
+		response := CaptchaResponse{Success: r.PostForm.Get("response") == "pass", Score: 0.9, Action: "login"}
+		if !response.Success {
+			response.ErrorCodes = []string{"invalid-input-response"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	captcha := &Captcha{URL: server.URL, Secret: "secret"}
+	result, err := captcha.Verify("pass", "192.0.2.1")
+	if err != nil || !result.Success || result.Score != 0.9 || result.Action != "login" {
+		t.Fatalf("Verify(pass) = %+v, %v", result, err)
+	}
+	result, err = captcha.Verify("fail", "192.0.2.1")
+	if err != nil || result.Success || len(result.ErrorCodes) != 1 {
+		t.Fatalf("Verify(fail) = %+v, %v", result, err)
+	}
+}
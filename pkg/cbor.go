@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errCBOR = errors.New("invalid cbor data")
+
+// WebAuthn 的資料最多只有幾層，限制巢狀深度避免惡意資料耗盡 stack
+const cborMaxDepth = 16
+
+// cborDecode 解析一個 CBOR 項目，回傳剩下未解析的資料。
+// 只支援 WebAuthn 會用到的型別：整數、byte string、text string、array、map、true/false/null
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeDepth(data, 0)
+}
+
+func cborDecodeDepth(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > cborMaxDepth {
+		return nil, nil, errCBOR
+	}
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24 && len(data) >= 1:
+		n, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		n, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		n, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		n, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		return nil, nil, errCBOR
+	}
+
+	switch major {
+	case 0:
+		return int64(n), data, nil
+	case 1:
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBOR
+		}
+		if major == 2 {
+			return data[:n], data[n:], nil
+		}
+		return string(data[:n]), data[n:], nil
+	case 4:
+		// 每個項目至少一個 byte，長度不可能超過剩下的資料，不能直接用 header 的長度配置記憶體
+		if uint64(len(data)) < n {
+			return nil, nil, errCBOR
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			item, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items, data = append(items, item), rest
+		}
+		return items, data, nil
+	case 5:
+		// 每組 key 與 value 至少兩個 byte
+		if uint64(len(data))/2 < n {
+			return nil, nil, errCBOR
+		}
+		m := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := cborDecodeDepth(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if _, ok := key.([]byte); ok {
+				return nil, nil, errCBOR
+			}
+			value, rest, err := cborDecodeDepth(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key], data = value, rest
+		}
+		return m, data, nil
+	case 7:
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+	}
+	return nil, nil, errCBOR
+}
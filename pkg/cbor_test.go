@@ -0,0 +1,53 @@
+package pkg
+
+import "testing"
+
+func TestCBORDecodeRejectsInvalidLength(t *testing.T) {
+	inputs := map[string][]byte{
+		// array 的長度遠超過資料長度
+		"huge array": {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		// map 的長度遠超過資料長度
+		"huge map": {0xba, 0x7f, 0xff, 0xff, 0xff},
+		// 資料不足以放下所有的項目
+		"short array": {0x83, 0x01, 0x02},
+		"short map":   {0xa2, 0x01, 0x02, 0x03},
+	}
+	for name, data := range inputs {
+		if _, _, err := cborDecode(data); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCBORDecodeDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		data := make([]byte, depth)
+		for i := range data {
+			data[i] = 0x81 // 只有一個項目的 array
+		}
+		return append(data, 0x00)
+	}
+	if _, _, err := cborDecode(nested(cborMaxDepth)); err != nil {
+		t.Errorf("depth %d: %v", cborMaxDepth, err)
+	}
+	if _, _, err := cborDecode(nested(cborMaxDepth + 1)); err == nil {
+		t.Errorf("depth %d: expected error", cborMaxDepth+1)
+	}
+	if _, _, err := cborDecode(nested(100000)); err == nil {
+		t.Error("deeply nested data: expected error")
+	}
+}
+
+func TestCBORDecode(t *testing.T) {
+	// {1: 2, 3: [-7, h'01', "a", true]}
+	data := []byte{0xa2, 0x01, 0x02, 0x03, 0x84, 0x26, 0x41, 0x01, 0x61, 0x61, 0xf5}
+	decoded, rest, err := cborDecode(data)
+	if err != nil || len(rest) != 0 {
+		t.Fatal(err, rest)
+	}
+	m := decoded.(map[interface{}]interface{})
+	items := m[int64(3)].([]interface{})
+	if m[int64(1)] != int64(2) || items[0] != int64(-7) || items[2] != "a" || items[3] != true {
+		t.Errorf("decoded = %v", decoded)
+	}
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GitHub 的預設網址，GitHub Enterprise Server 需要另外設定
+const (
+	GitHubURL    = "https://github.com"
+	GitHubAPIURL = "https://api.github.com"
+)
+
+// GitHubProvider 以 GitHub OAuth App 登入，GitHub 只支援 OAuth2，沒有 discovery 與 ID token，
+// 使用者資料從 /user 與 /user/emails API 取得
+type GitHubProvider struct {
+	// URL 網頁的網址，用來授權與換取 access token
+	URL          string
+	APIURL       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+}
+
+func (p *GitHubProvider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *GitHubProvider) webURL() string {
+	if p.URL != "" {
+		return strings.TrimSuffix(p.URL, "/")
+	}
+	return GitHubURL
+}
+
+func (p *GitHubProvider) apiURL() string {
+	if p.APIURL != "" {
+		return strings.TrimSuffix(p.APIURL, "/")
+	}
+	return GitHubAPIURL
+}
+
+// AuthCodeURL 產生導向 GitHub 的授權網址，GitHub 不支援 nonce，以 state 與 PKCE 防止偽造
+func (p *GitHubProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	query := url.Values{
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {PKCEChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	return p.webURL() + "/login/oauth/authorize?" + query.Encode(), nil
+}
+
+// Exchange 以 authorization code 換取 access token，再以 API 取得使用者資料
+func (p *GitHubProvider) Exchange(code, verifier, nonce string) (*OIDCClaims, error) {
+	form := url.Values{
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.webURL()+"/login/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// GitHub 換取失敗時也回傳 200，錯誤放在 error 欄位
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return nil, fmt.Errorf("github: token request failed: %s", token.Error)
+	}
+
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := p.getJSON("/user", token.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, errors.New("github: user id is missing")
+	}
+
+	// /user 的 email 是公開的 email，不一定驗證過，改用 /user/emails 中驗證過的主要 email
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := p.getJSON("/user/emails", token.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	// 以數字 id 作為 subject，login 可以被使用者修改
+	claims := &OIDCClaims{
+		Subject:           strconv.FormatInt(user.ID, 10),
+		Name:              user.Name,
+		PreferredUsername: user.Login,
+		Picture:           user.AvatarURL,
+	}
+	for _, email := range emails {
+		if email.Primary {
+			claims.Email = email.Email
+			claims.EmailVerified = email.Verified
+		}
+	}
+	return claims, nil
+}
+
+func (p *GitHubProvider) getJSON(path, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", p.apiURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("github: %s returned %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,284 @@
+package pkg
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	// ErrUnsupportedAlgorithm 不支援的簽章演算法
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	// ErrUnknownKey token 的 kid 找不到對應的金鑰
+	ErrUnknownKey = errors.New("unknown signing key")
+)
+
+// SigningKey 簽署 JWT 用的金鑰，HS512 為對稱金鑰，RS256 與 EdDSA 為非對稱金鑰
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	private   interface{}
+	public    interface{}
+}
+
+// NewHMACKey 以共享密鑰建立 HS512 金鑰
+func NewHMACKey(id string, secret []byte) *SigningKey {
+	return &SigningKey{
+		ID:        id,
+		Algorithm: jwt.SigningMethodHS512.Alg(),
+		private:   secret,
+		public:    secret,
+	}
+}
+
+// LoadSigningKey 從 PEM 檔讀取 RS256 或 EdDSA 私鑰，id 為空時以公鑰指紋作為 kid
+func LoadSigningKey(id, algorithm, path string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSigningKey(id, algorithm, data)
+}
+
+// ParseSigningKey 解析金鑰，HS512 的 data 即為密鑰，RS256 與 EdDSA 為 PEM 格式私鑰
+func ParseSigningKey(id, algorithm string, data []byte) (*SigningKey, error) {
+	key := &SigningKey{ID: id, Algorithm: algorithm}
+	switch algorithm {
+	case jwt.SigningMethodHS512.Alg():
+		return NewHMACKey(id, data), nil
+	case jwt.SigningMethodRS256.Alg():
+		private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+		key.public = &private.PublicKey
+	case jwt.SigningMethodEdDSA.Alg():
+		private, err := jwt.ParseEdPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, err
+		}
+		key.private = private
+		key.public = private.(ed25519.PrivateKey).Public()
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	if key.ID == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.public)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		key.ID = hex.EncodeToString(sum[:8])
+	}
+	return key, nil
+}
+
+// GenerateSigningKey 產生新的金鑰，回傳金鑰與可以交給 ParseSigningKey 的資料
+func GenerateSigningKey(algorithm string) (key *SigningKey, data []byte, err error) {
+	var private interface{}
+	switch algorithm {
+	case jwt.SigningMethodHS512.Alg():
+		secret, err := RandomToken(64)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = []byte(secret)
+		id, err := RandomToken(8)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewHMACKey(id, data), data, nil
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		err = ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	key, err = ParseSigningKey("", algorithm, data)
+	return
+}
+
+// Symmetric 是否為對稱金鑰，對稱金鑰不能公開
+func (k *SigningKey) Symmetric() bool {
+	_, ok := k.public.([]byte)
+	return ok
+}
+
+// Sign 簽署 token，header 帶上 kid
+func (k *SigningKey) Sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(k.Algorithm), claims)
+	token.Header["kid"] = k.ID
+	return token.SignedString(k.private)
+}
+
+// JWK 公鑰的 JWK 表示法，對稱金鑰回傳 nil
+func (k *SigningKey) JWK() map[string]interface{} {
+	jwk := map[string]interface{}{
+		"kid": k.ID,
+		"alg": k.Algorithm,
+		"use": "sig",
+	}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return nil
+	}
+	return jwk
+}
+
+// JWK JSON Web Key 的公鑰欄位
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWK 解析 JWK 公鑰，回傳的金鑰只能用來驗證
+func ParseJWK(jwk JWK) (*SigningKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	key := &SigningKey{ID: jwk.Kid, Algorithm: jwk.Alg}
+	switch jwk.Kty {
+	case "RSA":
+		if key.Algorithm == "" {
+			key.Algorithm = jwt.SigningMethodRS256.Alg()
+		}
+		if _, ok := jwt.GetSigningMethod(key.Algorithm).(*jwt.SigningMethodRSA); !ok {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		n, err1 := decode(jwk.N)
+		e, err2 := decode(jwk.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrUnknownKey
+		}
+		key.public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		if jwk.Crv != "P-256" || (key.Algorithm != "" && key.Algorithm != jwt.SigningMethodES256.Alg()) {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		key.Algorithm = jwt.SigningMethodES256.Alg()
+		x, err1 := decode(jwk.X)
+		y, err2 := decode(jwk.Y)
+		if err1 != nil || err2 != nil {
+			return nil, ErrUnknownKey
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, ErrUnknownKey
+		}
+		key.public = public
+	case "OKP":
+		if jwk.Crv != "Ed25519" || (key.Algorithm != "" && key.Algorithm != jwt.SigningMethodEdDSA.Alg()) {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		key.Algorithm = jwt.SigningMethodEdDSA.Alg()
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnknownKey
+		}
+		key.public = ed25519.PublicKey(x)
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+	return key, nil
+}
+
+// ParseToken 驗證 token 簽章與有效期限，lookup 依 kid 找出驗證用的金鑰
+func ParseToken(tokenString string, lookup func(kid string) *SigningKey) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key := lookup(kid)
+		if key == nil {
+			return nil, ErrUnknownKey
+		}
+		if t.Method.Alg() != key.Algorithm {
+			return nil, ErrUnsupportedAlgorithm
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token.Claims.(jwt.MapClaims), nil
+}
+
+// KeyRing 一把用來簽署的金鑰，加上多把只用來驗證的金鑰
+type KeyRing struct {
+	signing *SigningKey
+	keys    map[string]*SigningKey
+}
+
+// NewKeyRing 建立 KeyRing
+func NewKeyRing(signing *SigningKey, verify ...*SigningKey) *KeyRing {
+	ring := &KeyRing{
+		signing: signing,
+		keys:    map[string]*SigningKey{signing.ID: signing},
+	}
+	for _, key := range verify {
+		ring.keys[key.ID] = key
+	}
+	return ring
+}
+
+// Signing 目前用來簽署 token 的金鑰
+func (r *KeyRing) Signing() *SigningKey {
+	return r.signing
+}
+
+// Lookup 依 kid 找出驗證用的金鑰，沒有 kid 的舊 token 只能用對稱的簽署金鑰驗證
+func (r *KeyRing) Lookup(kid string) *SigningKey {
+	if kid == "" {
+		if r.signing.Symmetric() {
+			return r.signing
+		}
+		return nil
+	}
+	return r.keys[kid]
+}
+
+// JWKS 所有非對稱金鑰的公鑰
+func (r *KeyRing) JWKS() []map[string]interface{} {
+	keys := []map[string]interface{}{}
+	for _, key := range r.keys {
+		if jwk := key.JWK(); jwk != nil {
+			keys = append(keys, jwk)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,97 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func writeKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "key*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return f.Name()
+}
+
+func TestAsymmetricSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]interface{}{
+		"RS256": rsaKey,
+		"EdDSA": edKey,
+	}
+	for algorithm, private := range keys {
+		path := writeKey(t, private)
+		defer os.Remove(path)
+
+		key, err := LoadSigningKey("", algorithm, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.ID == "" || key.Symmetric() || key.JWK() == nil {
+			t.Fail()
+		}
+		token, err := key.Sign(jwt.MapClaims{"id": "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := ParseToken(token, func(kid string) *SigningKey {
+			if kid == key.ID {
+				return key
+			}
+			return nil
+		})
+		if err != nil || claims["id"] != "1" {
+			t.Fail()
+		}
+		if _, err := ParseToken(token, func(string) *SigningKey { return nil }); err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestHMACKeyIsNotPublished(t *testing.T) {
+	key := NewHMACKey("default", []byte("secret"))
+	if !key.Symmetric() || key.JWK() != nil {
+		t.Fail()
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	for _, algorithm := range []string{"RS256", "EdDSA"} {
+		key, _, err := GenerateSigningKey(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := json.Marshal(key.JWK())
+		var jwk JWK
+		json.Unmarshal(data, &jwk)
+		public, err := ParseJWK(jwk)
+		if err != nil || public.ID != key.ID || public.Algorithm != algorithm {
+			t.Fatal(err)
+		}
+		token, _ := key.Sign(jwt.MapClaims{"id": "1"})
+		claims, err := ParseToken(token, func(string) *SigningKey { return public })
+		if err != nil || claims["id"] != "1" {
+			t.Fail()
+		}
+	}
+	if _, err := ParseJWK(JWK{Kty: "RSA", Alg: "HS256", N: "AQAB", E: "AQAB"}); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// 加密過的私鑰開頭，沒有這個開頭的是加密功能加入前存入的明文
+const encryptedKeyPrefix = "enc:v1:"
+
+// ErrNoKeyEncryptionKey 沒有設定 SIGNING_KEY_ENCRYPTION_KEY
+var ErrNoKeyEncryptionKey = errors.New("SIGNING_KEY_ENCRYPTION_KEY environment variable is not set")
+
+// keyEncryptionKey 以 SIGNING_KEY_ENCRYPTION_KEY 推導 AES-256 金鑰
+func keyEncryptionKey() ([]byte, error) {
+	secret := os.Getenv("SIGNING_KEY_ENCRYPTION_KEY")
+	if secret == "" {
+		return nil, ErrNoKeyEncryptionKey
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:], nil
+}
+
+func keyEncryptionCipher() (cipher.AEAD, error) {
+	kek, err := keyEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncryptedPrivateKey 資料庫中的私鑰或兩步驟驗證密鑰是否已經加密
+func IsEncryptedPrivateKey(stored string) bool {
+	return strings.HasPrefix(stored, encryptedKeyPrefix)
+}
+
+// 每種資料使用不同的 additional data，避免把一個欄位的密文搬到另一個欄位使用
+const (
+	privateKeyAdditionalData = encryptedKeyPrefix
+	totpAdditionalData       = encryptedKeyPrefix + "totp"
+)
+
+// encryptAtRest 以 SIGNING_KEY_ENCRYPTION_KEY 加密要存入資料庫的資料
+func encryptAtRest(data []byte, additionalData string) (string, error) {
+	aead, err := keyEncryptionCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, data, []byte(additionalData))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptAtRest 解密資料庫中的資料，尚未加密的舊資料直接回傳
+func decryptAtRest(stored, additionalData string) ([]byte, error) {
+	if !IsEncryptedPrivateKey(stored) {
+		return []byte(stored), nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := keyEncryptionCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is invalid")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, []byte(additionalData))
+	if err != nil {
+		return nil, errors.New("cannot decrypt data, check SIGNING_KEY_ENCRYPTION_KEY")
+	}
+	return data, nil
+}
+
+// EncryptPrivateKey 以 SIGNING_KEY_ENCRYPTION_KEY 加密要存入資料庫的私鑰，
+// 資料庫外流時沒有這個環境變數也不能偽造 token
+func EncryptPrivateKey(data []byte) (string, error) {
+	return encryptAtRest(data, privateKeyAdditionalData)
+}
+
+// DecryptPrivateKey 解密資料庫中的私鑰，尚未加密的舊資料直接回傳
+func DecryptPrivateKey(stored string) ([]byte, error) {
+	return decryptAtRest(stored, privateKeyAdditionalData)
+}
+
+// EncryptTOTPSecret 以與私鑰相同的金鑰加密兩步驟驗證的密鑰
+func EncryptTOTPSecret(secret string) (string, error) {
+	return encryptAtRest([]byte(secret), totpAdditionalData)
+}
+
+// DecryptTOTPSecret 解密資料庫中兩步驟驗證的密鑰，尚未加密的舊資料直接回傳
+func DecryptTOTPSecret(stored string) (string, error) {
+	secret, err := decryptAtRest(stored, totpAdditionalData)
+	return string(secret), err
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEncryptPrivateKey(t *testing.T) {
+	defer os.Unsetenv("SIGNING_KEY_ENCRYPTION_KEY")
+	os.Unsetenv("SIGNING_KEY_ENCRYPTION_KEY")
+	if _, err := EncryptPrivateKey([]byte("secret")); err != ErrNoKeyEncryptionKey {
+		t.Errorf("encrypt without key encryption key: %v", err)
+	}
+
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "key encryption key")
+	stored, err := EncryptPrivateKey([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedPrivateKey(stored) {
+		t.Errorf("%q is not marked as encrypted", stored)
+	}
+	data, err := DecryptPrivateKey(stored)
+	if err != nil || string(data) != "secret" {
+		t.Errorf("decrypt = %q, %v", data, err)
+	}
+	// 加密功能加入前存入的明文
+	data, err = DecryptPrivateKey("plain")
+	if err != nil || string(data) != "plain" {
+		t.Errorf("decrypt plaintext = %q, %v", data, err)
+	}
+
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "another key")
+	if _, err := DecryptPrivateKey(stored); err == nil {
+		t.Error("decrypt with wrong key encryption key succeeded")
+	}
+}
+
+func TestEncryptTOTPSecret(t *testing.T) {
+	defer os.Unsetenv("SIGNING_KEY_ENCRYPTION_KEY")
+	os.Setenv("SIGNING_KEY_ENCRYPTION_KEY", "key encryption key")
+	stored, err := EncryptTOTPSecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) > 128 {
+		t.Errorf("encrypted secret is %d characters", len(stored))
+	}
+	secret, err := DecryptTOTPSecret(stored)
+	if err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("decrypt = %q, %v", secret, err)
+	}
+	// 不能把密鑰的密文當作私鑰使用
+	if _, err := DecryptPrivateKey(stored); err == nil {
+		t.Error("decrypt totp secret as private key succeeded")
+	}
+}
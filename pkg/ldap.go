@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrLDAPInvalidCredentials 帳號不存在或密碼錯誤
+var ErrLDAPInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// LDAP 以 simple bind 驗證目錄服務（LDAP、Active Directory）的帳號密碼
+type LDAP struct {
+	URL      string
+	StartTLS bool
+	// 有設定時先以服務帳號搜尋使用者的 DN 再 bind，否則以 UserDN 樣板組出 DN
+	BindDN       string
+	BindPassword string
+	// 例如 uid=%s,ou=people,dc=ncnu,dc=edu,dc=tw，Active Directory 可以使用 %s@ncnu.edu.tw
+	UserDN string
+	// 搜尋使用者的位置與條件，例如 (uid=%s)
+	BaseDN     string
+	UserFilter string
+
+	EmailAttribute     string
+	NameAttribute      string
+	StudentIDAttribute string
+	Timeout            time.Duration
+}
+
+// LDAPEntry 目錄中的使用者資料
+type LDAPEntry struct {
+	DN        string
+	Email     string
+	Name      string
+	StudentID string
+}
+
+// escapeDN 跳脫 DN 中有特殊意義的字元（RFC 4514）
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			(r == ' ' || r == '#') && i == 0,
+			r == ' ' && i == len(s)-1:
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if l.StartTLS {
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// search 搜尋使用者，找不到或找到多筆時視為帳號不存在
+func (l *LDAP) search(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	// 1.1 代表不需要任何屬性
+	attributes := []string{"1.1"}
+	for _, attribute := range []string{l.EmailAttribute, l.NameAttribute, l.StudentIDAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	if len(attributes) > 1 {
+		attributes = attributes[1:]
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(username)),
+		attributes,
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// Authenticate 以使用者的密碼 bind，成功時回傳目錄中的使用者資料
+func (l *LDAP) Authenticate(username, password string) (*LDAPEntry, error) {
+	// 空密碼的 simple bind 會被視為匿名登入而成功
+	if username == "" || password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var entry *ldap.Entry
+	dn := fmt.Sprintf(l.UserDN, escapeDN(username))
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, err
+		}
+		if entry, err = l.search(conn, username); err != nil {
+			return nil, err
+		}
+		dn = entry.DN
+	}
+
+	if err := conn.Bind(dn, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, err
+	}
+
+	// 沒有服務帳號時以使用者自己的權限讀取資料
+	if entry == nil && l.BaseDN != "" {
+		if entry, err = l.search(conn, username); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &LDAPEntry{DN: dn}
+	if entry != nil {
+		result.Email = entry.GetAttributeValue(l.EmailAttribute)
+		result.Name = entry.GetAttributeValue(l.NameAttribute)
+		result.StudentID = entry.GetAttributeValue(l.StudentIDAttribute)
+	}
+	return result, nil
+}
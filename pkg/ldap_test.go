@@ -0,0 +1,18 @@
+package pkg
+
+import "testing"
+
+func TestEscapeDN(t *testing.T) {
+	cases := map[string]string{
+		"s110213001": "s110213001",
+		"a,b=c":      `a\,b\=c`,
+		" #admin ":   `\ #admin\ `,
+		"#admin":     `\#admin`,
+		`x+y<z>;"w\`: `x\+y\<z\>\;\"w\\`,
+	}
+	for input, expected := range cases {
+		if escaped := escapeDN(input); escaped != expected {
+			t.Errorf("escapeDN(%q) = %q, want %q", input, escaped, expected)
+		}
+	}
+}
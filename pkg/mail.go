@@ -3,6 +3,7 @@ package pkg
 import (
 	"bytes"
 	"fmt"
+	"mime"
 	"net/smtp"
 	"os"
 	"strconv"
@@ -10,23 +11,17 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// DeliverMail 實際寄出信件的方式，測試時可以替換成記錄信件內容
+var DeliverMail = deliverSMTP
+
 // SendEmail sends an email
 func SendEmail(to string) (code string, err error) {
-	var client *smtp.Client
 	subject := os.Getenv("EMAIL_SUBJECT")
-	from := os.Getenv("EMAIL_FROM")
-	smtpServer := os.Getenv("SMTP_SERVER")
 	codeLength := os.Getenv("VERIFY_CODE_LENGTH")
 	if gin.Mode() == gin.ReleaseMode {
-		if smtpServer == "" {
-			err = fmt.Errorf("SMTP_SERVER environment variable is not set")
-		}
 		if subject == "" {
 			err = fmt.Errorf("SMTP_SUBJECT environment variable is not set")
 		}
-		if from == "" {
-			err = fmt.Errorf("SMTP_FROM environment variable is not set")
-		}
 		if codeLength == "" {
 			err = fmt.Errorf("VERIFY_CODE_LENGTH environment variable is not set")
 		}
@@ -43,33 +38,61 @@ func SendEmail(to string) (code string, err error) {
 	}
 
 	code = randString(length)
+	err = sendMail(to, subject, "Verify code is "+code+"\r\n")
+	return
+}
+
+// SendLink 寄送連結，例如登入連結，text 為連結前的說明
+func SendLink(to, subject, text, link string) error {
+	return sendMail(to, subject, text+"\r\n\r\n"+link+"\r\n")
+}
+
+func sendMail(to, subject, body string) error {
+	buf := bytes.NewBufferString("To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		body)
+	return DeliverMail(to, buf.Bytes())
+}
+
+// deliverSMTP 以 SMTP_SERVER 寄信，不是正式環境時不寄信
+func deliverSMTP(to string, message []byte) error {
 	if gin.Mode() != gin.ReleaseMode {
-		return
+		return nil
+	}
+	from := os.Getenv("EMAIL_FROM")
+	smtpServer := os.Getenv("SMTP_SERVER")
+	if smtpServer == "" {
+		return fmt.Errorf("SMTP_SERVER environment variable is not set")
+	}
+	if from == "" {
+		return fmt.Errorf("SMTP_FROM environment variable is not set")
 	}
 
-	client, err = smtp.Dial(smtpServer)
+	client, err := smtp.Dial(smtpServer)
 	if err != nil {
-		return
+		return err
 	}
 	defer client.Close()
 
-	client.Mail(from)
-	client.Rcpt(to)
-
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
 	wc, err := client.Data()
 	if err != nil {
-		return
+		return err
 	}
-	defer wc.Close()
-
-	buf := bytes.NewBufferString("To: " + to + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"\r\n" +
-		"Verify code is " + code + "r\n")
-
-	if _, err = buf.WriteTo(wc); err != nil {
-		return
+	if _, err := wc.Write(message); err != nil {
+		wc.Close()
+		return err
 	}
-
-	return
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
 }
@@ -0,0 +1,30 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSendLink(t *testing.T) {
+	deliver := DeliverMail
+	defer func() { DeliverMail = deliver }()
+	var to, message string
+	DeliverMail = func(recipient string, data []byte) error {
+		to, message = recipient, string(data)
+		return nil
+	}
+
+	if err := SendLink("user@ncnu.edu.tw", "登入連結", "Sign in:", "https://oj.ncnu.edu.tw/login?token=abc"); err != nil {
+		t.Fatal(err)
+	}
+	if to != "user@ncnu.edu.tw" {
+		t.Errorf("recipient = %q", to)
+	}
+	header := "Subject: =?utf-8?q?=E7=99=BB=E5=85=A5=E9=80=A3=E7=B5=90?=\r\n"
+	if !strings.Contains(message, header) {
+		t.Errorf("message %q does not contain encoded subject", message)
+	}
+	if !strings.HasSuffix(message, "\r\n\r\nSign in:\r\n\r\nhttps://oj.ncnu.edu.tw/login?token=abc\r\n") {
+		t.Errorf("message %q does not end with the link", message)
+	}
+}
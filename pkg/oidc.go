@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 同一個 provider 的 JWKS 最短多久重新下載一次，避免不認識的 kid 造成大量請求
+const oidcKeysRefreshInterval = time.Minute
+
+// ErrIDTokenInvalid ID token 驗證失敗
+var ErrIDTokenInvalid = errors.New("id token is invalid")
+
+// OIDCProvider 外部 OpenID Connect 身分提供者，endpoint 透過 discovery 取得
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	Client       *http.Client
+
+	mutex         sync.Mutex
+	metadata      *oidcMetadata
+	keys          map[string]*SigningKey
+	keysFetchedAt time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// OIDCClaims ID token 中登入需要的欄位
+type OIDCClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Picture           string
+}
+
+// PKCEChallenge 以 S256 計算 code verifier 的 code challenge
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *OIDCProvider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *OIDCProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := p.client().Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s returned %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover 取得 provider 的 metadata，成功後快取
+func (p *OIDCProvider) discover() (*oidcMetadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	var metadata oidcMetadata
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Issuer != p.Issuer || metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("oidc: provider metadata is invalid")
+	}
+	p.metadata = &metadata
+	return p.metadata, nil
+}
+
+// AuthCodeURL 產生導向 provider 的授權網址，使用 PKCE 與 nonce
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {PKCEChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange 以 authorization code 換取 ID token 並驗證
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCClaims, error) {
+	metadata, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	// 預設為 client_secret_basic，provider 只支援 client_secret_post 時才放在 body
+	basic := len(metadata.TokenAuthMethods) == 0
+	for _, method := range metadata.TokenAuthMethods {
+		basic = basic || method == "client_secret_basic"
+	}
+	if !basic {
+		form.Set("client_id", p.ClientID)
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token request failed: %s", token.Error)
+	}
+	return p.VerifyIDToken(token.IDToken, nonce)
+}
+
+// lookupKey 依 kid 找出 provider 的公鑰，找不到時重新下載 JWKS 以支援 provider 輪替金鑰
+func (p *OIDCProvider) lookupKey(kid string) *SigningKey {
+	metadata, err := p.discover()
+	if err != nil {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	find := func() *SigningKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, key := range p.keys {
+				return key
+			}
+		}
+		return p.keys[kid]
+	}
+	if key := find(); key != nil || time.Since(p.keysFetchedAt) < oidcKeysRefreshInterval {
+		return key
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	p.keysFetchedAt = time.Now()
+	if err := p.getJSON(metadata.JWKSURI, &jwks); err != nil {
+		return nil
+	}
+	p.keys = map[string]*SigningKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := ParseJWK(jwk); err == nil {
+			p.keys[key.ID] = key
+		}
+	}
+	return find()
+}
+
+// VerifyIDToken 驗證 ID token 的簽章、issuer、audience、有效期限與 nonce
+func (p *OIDCProvider) VerifyIDToken(idToken, nonce string) (*OIDCClaims, error) {
+	claims, err := ParseToken(idToken, p.lookupKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := claims["exp"].(float64); !ok || claims["iss"] != p.Issuer {
+		return nil, ErrIDTokenInvalid
+	}
+	if !claims.VerifyAudience(p.ClientID, true) {
+		return nil, ErrIDTokenInvalid
+	}
+	// 有多個 audience 時 azp 必須是自己
+	if audiences, ok := claims["aud"].([]interface{}); ok && len(audiences) > 1 && claims["azp"] != p.ClientID {
+		return nil, ErrIDTokenInvalid
+	}
+	tokenNonce, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return nil, ErrIDTokenInvalid
+	}
+
+	result := &OIDCClaims{}
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.Name, _ = claims["name"].(string)
+	result.PreferredUsername, _ = claims["preferred_username"].(string)
+	result.Picture, _ = claims["picture"].(string)
+	// 部分 provider 以字串表示 email_verified
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = verified
+	case string:
+		result.EmailVerified = verified == "true"
+	}
+	if result.Subject == "" {
+		return nil, ErrIDTokenInvalid
+	}
+	return result, nil
+}
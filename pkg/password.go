@@ -1,6 +1,11 @@
 package pkg
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 //Encrypt 密碼加密
 func Encrypt(source string) (string, error) {
@@ -12,3 +17,9 @@ func Encrypt(source string) (string, error) {
 func Compare(hashedPassword, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
+
+//HashToken 高熵亂數 token 的雜湊，不需要 bcrypt
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// proofOfWorkBits SHA-256(challenge:nonce) 開頭為 0 的位元數
+func proofOfWorkBits(challenge, nonce string) int {
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// CheckProofOfWork 檢查 SHA-256(challenge:nonce) 開頭至少有 difficulty 個位元為 0
+func CheckProofOfWork(challenge, nonce string, difficulty int) bool {
+	return nonce != "" && len(nonce) <= 32 && proofOfWorkBits(challenge, nonce) >= difficulty
+}
+
+// SolveProofOfWork 從 0 開始嘗試，回傳第一個符合難度的 nonce，平均需要計算 2^difficulty 次
+func SolveProofOfWork(challenge string, difficulty int) string {
+	for i := uint64(0); ; i++ {
+		nonce := strconv.FormatUint(i, 10)
+		if proofOfWorkBits(challenge, nonce) >= difficulty {
+			return nonce
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package pkg
+
+import "testing"
+
+func TestProofOfWork(t *testing.T) {
+	challenge := "challenge"
+	nonce := SolveProofOfWork(challenge, 12)
+	if !CheckProofOfWork(challenge, nonce, 12) {
+		t.Fatalf("nonce %s does not solve the challenge", nonce)
+	}
+	if CheckProofOfWork("other challenge", nonce, 12) && CheckProofOfWork("another challenge", nonce, 12) {
+		t.Errorf("nonce %s solves unrelated challenges", nonce)
+	}
+	if CheckProofOfWork(challenge, "", 0) {
+		t.Error("empty nonce is accepted")
+	}
+}
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	crand "crypto/rand"
+	"encoding/base64"
 	"math/rand"
 	"time"
 )
@@ -18,3 +20,26 @@ func randString(n int) string {
 	}
 	return string(b)
 }
+
+// RandomToken 產生 n bytes 的安全亂數，以 URL-safe base64 編碼
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var codeRunes = []byte("abcdefghijkmnpqrstuvwxyz23456789")
+
+// RandomCode 產生 n 個字元、方便人工輸入的安全亂數，不含容易混淆的字元
+func RandomCode(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = codeRunes[int(b[i])%len(codeRunes)]
+	}
+	return string(b), nil
+}
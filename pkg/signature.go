@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// SignRequest 以 HMAC-SHA256 簽署服務之間的請求，
+// 簽署內容為 method、path 與 query、時間戳記、nonce 與 body 的雜湊，以換行分隔
+func SignRequest(secret []byte, method, uri, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{
+		strings.ToUpper(method),
+		uri,
+		timestamp,
+		nonce,
+		hex.EncodeToString(sum[:]),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequestSignature 以固定時間比對請求的簽章
+func VerifyRequestSignature(secret []byte, method, uri, timestamp, nonce string, body []byte, signature string) bool {
+	expected := SignRequest(secret, method, uri, timestamp, nonce, body)
+	return hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B 的 SHA1 測試向量，取後六碼
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil || code != expected {
+			t.Errorf("%d: got %s, want %s", unix, code, expected)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, _ := GenerateTOTPSecret()
+	now := time.Now()
+	code, _ := TOTPCode(secret, TOTPStep(now))
+	step, ok := ValidateTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fail()
+	}
+	if _, ok := ValidateTOTP(secret, code, now, step); ok {
+		t.Error("code should not be accepted twice")
+	}
+}
@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// WebAuthn COSE 演算法
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+const (
+	authDataFlagUserPresent      = 0x01
+	authDataFlagUserVerified     = 0x04
+	authDataFlagAttestedCredData = 0x40
+)
+
+var (
+	// ErrWebAuthnVerify WebAuthn 驗證失敗
+	ErrWebAuthnVerify = errors.New("webauthn verification failed")
+	// ErrUnsupportedCOSEKey 不支援的公鑰格式
+	ErrUnsupportedCOSEKey = errors.New("unsupported cose key")
+)
+
+// WebAuthn relying party 設定
+type WebAuthn struct {
+	RPID    string
+	RPName  string
+	Origins []string
+}
+
+// AuthenticatorData 驗證器回傳的 authenticator data
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	// COSE 格式的公鑰，只有註冊時會有
+	PublicKey []byte
+}
+
+// UserVerified 驗證器是否有驗證使用者（PIN、生物辨識）
+func (a *AuthenticatorData) UserVerified() bool {
+	return a.Flags&authDataFlagUserVerified != 0
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func parseAuthenticatorData(data []byte) (*AuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, ErrWebAuthnVerify
+	}
+	authData := &AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&authDataFlagAttestedCredData == 0 {
+		return authData, nil
+	}
+
+	// aaguid(16) + credential id 長度(2) + credential id + COSE 公鑰
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, ErrWebAuthnVerify
+	}
+	length := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < length {
+		return nil, ErrWebAuthnVerify
+	}
+	authData.CredentialID = rest[:length]
+	_, after, err := cborDecode(rest[length:])
+	if err != nil {
+		return nil, err
+	}
+	authData.PublicKey = rest[length : len(rest)-len(after)]
+	return authData, nil
+}
+
+// verify 檢查 client data 與 authenticator data 是否符合這個 relying party
+func (w *WebAuthn) verify(ceremony, challenge string, clientDataJSON []byte, authData *AuthenticatorData) error {
+	var client clientData
+	if err := json.Unmarshal(clientDataJSON, &client); err != nil {
+		return ErrWebAuthnVerify
+	}
+	if client.Type != ceremony || client.Challenge != challenge {
+		return ErrWebAuthnVerify
+	}
+	originAllowed := false
+	for _, origin := range w.Origins {
+		originAllowed = originAllowed || client.Origin == origin
+	}
+	if !originAllowed {
+		return ErrWebAuthnVerify
+	}
+
+	rpIDHash := sha256.Sum256([]byte(w.RPID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return ErrWebAuthnVerify
+	}
+	if authData.Flags&authDataFlagUserPresent == 0 || !authData.UserVerified() {
+		return ErrWebAuthnVerify
+	}
+	return nil
+}
+
+// VerifyRegistration 驗證註冊的 attestation，不驗證 attestation statement（attestation: none）
+func (w *WebAuthn) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*AuthenticatorData, int, error) {
+	decoded, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, 0, err
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrWebAuthnVerify
+	}
+	raw, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, 0, ErrWebAuthnVerify
+	}
+	authData, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := w.verify("webauthn.create", challenge, clientDataJSON, authData); err != nil {
+		return nil, 0, err
+	}
+	if authData.PublicKey == nil {
+		return nil, 0, ErrWebAuthnVerify
+	}
+	_, algorithm, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return authData, algorithm, nil
+}
+
+// VerifyAssertion 驗證登入的 assertion 簽章
+func (w *WebAuthn) VerifyAssertion(challenge string, publicKey, clientDataJSON, rawAuthData, signature []byte) (*AuthenticatorData, error) {
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.verify("webauthn.get", challenge, clientDataJSON, authData); err != nil {
+		return nil, err
+	}
+
+	key, algorithm, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	valid := false
+	switch algorithm {
+	case COSEAlgES256:
+		valid = ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature)
+	case COSEAlgEdDSA:
+		valid = ed25519.Verify(key.(ed25519.PublicKey), signed, signature)
+	case COSEAlgRS256:
+		valid = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return nil, ErrWebAuthnVerify
+	}
+	return authData, nil
+}
+
+// parseCOSEKey 解析 COSE 公鑰，支援 ES256、EdDSA、RS256
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	decoded, _, err := cborDecode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, ErrUnsupportedCOSEKey
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	x, _ := m[int64(-2)].([]byte)
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256:
+		y, _ := m[int64(-3)].([]byte)
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, ErrUnsupportedCOSEKey
+		}
+		return key, COSEAlgES256, nil
+	case kty == 1 && alg == COSEAlgEdDSA && len(x) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(x), COSEAlgEdDSA, nil
+	case kty == 3 && alg == COSEAlgRS256:
+		// RSA 公鑰的 -1 為 n，-2 為 e
+		n, _ := m[int64(-1)].([]byte)
+		e := new(big.Int).SetBytes(x)
+		if len(n) == 0 || !e.IsInt64() {
+			return nil, 0, ErrUnsupportedCOSEKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(e.Int64())}, COSEAlgRS256, nil
+	}
+	return nil, 0, ErrUnsupportedCOSEKey
+}
+
+// WebAuthnEncode WebAuthn 的 binary 欄位以 base64url 傳遞
+func WebAuthnEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// WebAuthnDecode 解碼 base64url，容許有 padding
+func WebAuthnDecode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
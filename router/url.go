@@ -1,24 +1,228 @@
 package router
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/NCNUCodeOJ/BackendUser/models"
 	"github.com/NCNUCodeOJ/BackendUser/views"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
 
+func unauthorized(c *gin.Context, code int, message string) {
+	c.Header("WWW-Authenticate", "JWT realm=NCNUOJ")
+	c.AbortWithStatusJSON(code, gin.H{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// personal access token 可以使用的 API 與需要的 scope，其他 API 只接受登入取得的 access token
+var personalAccessTokenRoutes = map[string]string{
+	"GET /api/v1/user":                 "read:user",
+	"PATCH /api/v1/user":               "write:user",
+	"POST /api/v1/username":            "read:user",
+	"POST /api/v1/announcements":       "write:announcements",
+	"DELETE /api/v1/announcements/:id": "write:announcements",
+}
+
+// personalAccessTokenAuth 驗證 personal access token 與這個 API 需要的 scope
+func personalAccessTokenAuth(c *gin.Context, token string) {
+	scope, ok := personalAccessTokenRoutes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		unauthorized(c, http.StatusForbidden, "personal access token is not allowed")
+		return
+	}
+	claims, err := views.VerifyPersonalAccessToken(token)
+	if err != nil {
+		unauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if !views.HasScope(claims, scope) {
+		unauthorized(c, http.StatusForbidden, "token does not have scope "+scope)
+		return
+	}
+	c.Set("JWT_PAYLOAD", claims)
+	c.Next()
+}
+
+// authRequired 驗證 Authorization header 的 access token 或 personal access token，
+// 沒有 Authorization header 時在 cookie 模式下改用 cookie 中的 access token，並確認 token 與 session 尚未被撤銷
+func authRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var token string
+		if header := c.GetHeader("Authorization"); header == "" && views.CookieAccessToken(c) != "" {
+			// 瀏覽器會自動帶上 cookie，需要確認請求來自前端
+			if !views.CheckCSRF(c) {
+				views.AbortCSRF(c)
+				return
+			}
+			token = views.CookieAccessToken(c)
+		} else {
+			parts := strings.SplitN(header, " ", 2)
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				unauthorized(c, http.StatusUnauthorized, "auth header is invalid")
+				return
+			}
+			if strings.HasPrefix(parts[1], views.PersonalAccessTokenPrefix) {
+				personalAccessTokenAuth(c, parts[1])
+				return
+			}
+			token = parts[1]
+		}
+		claims, err := views.VerifyToken(token)
+		if err != nil {
+			unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
+		jti, ok := claims["jti"].(string)
+		if !ok {
+			unauthorized(c, http.StatusUnauthorized, "token is invalid")
+			return
+		}
+		revoked, err := models.IsTokenRevoked(jti)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": "系統錯誤",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if revoked {
+			unauthorized(c, http.StatusUnauthorized, "token has been revoked")
+			return
+		}
+		active, err := views.CheckSession(claims)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": "系統錯誤",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if !active {
+			unauthorized(c, http.StatusUnauthorized, "session has been revoked")
+			return
+		}
+		c.Set("JWT_PAYLOAD", claims)
+		c.Next()
+	}
+}
+
+// 每個 private API 需要的服務權限，沒有列出的 API 不開放給任何服務
+var privateAPIPermissions = map[string]string{
+	"POST /api/private/v1/username":   "username",
+	"POST /api/private/v1/introspect": "introspect",
+}
+
+// serviceRequired 驗證呼叫 private API 的服務與服務的權限
+func serviceRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, err := views.AuthenticateService(c)
+		if errors.Is(err, views.ErrServiceUnauthorized) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    http.StatusUnauthorized,
+				"message": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": "系統錯誤",
+				"error":   err.Error(),
+			})
+			return
+		}
+		permission, ok := privateAPIPermissions[c.Request.Method+" "+c.FullPath()]
+		if !ok || !views.ServiceAllowed(name, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code":    http.StatusForbidden,
+				"message": "Permission denied",
+			})
+			return
+		}
+		c.Set("service", name)
+		c.Next()
+	}
+}
+
+// notImpersonating 管理員模擬使用者時不能進行的敏感操作
+func notImpersonating() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := views.Impersonator(c); ok {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code":    http.StatusForbidden,
+				"message": "not allowed while impersonating",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// sudoRequired 設定為敏感操作的 API 需要最近驗證過身分
+func sudoRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !views.SudoRequired(c.Request.Method, c.FullPath()) {
+			c.Next()
+			return
+		}
+		elevated, err := views.IsElevated(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"message": "系統錯誤",
+				"error":   err.Error(),
+			})
+			return
+		}
+		if !elevated {
+			views.AbortSudoRequired(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// oauthProviderRequired 沒有設定 OAUTH_ISSUER 時不提供 OAuth 與 OpenID Connect 服務
+func oauthProviderRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !views.OAuthProviderEnabled() {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"message": "OAuth provider is not enabled",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// magicLinkRequired 沒有設定登入連結的網址時不提供 magic link 登入
+func magicLinkRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !views.MagicLinkEnabled() {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"message": "magic link login is not enabled",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// getUserInfo 以資料庫中目前的權限取代 token 中的權限，權限變更後舊的 token 立即失效
 func getUserInfo() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id, err := strconv.Atoi(jwt.ExtractClaims(c)["id"].(string))
+		user, err := views.TokenUser(views.ExtractClaims(c))
+		if errors.Is(err, views.ErrTokenOutdated) {
+			unauthorized(c, http.StatusUnauthorized, err.Error())
+			return
+		}
 		if err != nil {
 			c.Abort()
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -26,9 +230,9 @@ func getUserInfo() gin.HandlerFunc {
 				"error":   err.Error(),
 			})
 		} else {
-			c.Set("userID", uint(id))
-			c.Set("teacher", jwt.ExtractClaims(c)["teacher"].(bool))
-			c.Set("admin", jwt.ExtractClaims(c)["admin"].(bool))
+			c.Set("userID", user.ID)
+			c.Set("teacher", user.Teacher)
+			c.Set("admin", user.Admin)
 			c.Next()
 		}
 	}
@@ -42,29 +246,6 @@ func SetupRouter() *gin.Engine {
 			log.Println("Error loading .env file")
 		}
 	}
-	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:            "NCNUOJ",
-		SigningAlgorithm: "HS512",
-		Key:              []byte(os.Getenv("SECRET_KEY")),
-		Timeout:          4 * time.Hour,
-		MaxRefresh:       time.Hour,
-		Authenticator:    views.Login,
-		TimeFunc:         time.Now,
-		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			if v, ok := data.(*models.User); ok {
-				return jwt.MapClaims{
-					"id":       strconv.FormatUint(uint64(v.ID), 10),
-					"username": v.UserName,
-					"admin":    v.Admin,
-					"teacher":  v.Teacher,
-				}
-			}
-			return jwt.MapClaims{}
-		},
-	})
-	if err != nil {
-		log.Fatal("JWT Error:" + err.Error())
-	}
 	baseURL := "api/v1"
 	privateBaseURL := "api/private/v1"
 	r := gin.Default()
@@ -75,40 +256,105 @@ func SetupRouter() *gin.Engine {
 		r.Use(cors.New(cors.Config{
 			AllowOrigins:     origins,
 			AllowMethods:     []string{"PUT", "PATCH", "POST", "GET", "DELETE"},
-			AllowHeaders:     []string{"Origin, Authorization, Content-Type, Accept"},
+			AllowHeaders:     []string{"Origin, Authorization, Content-Type, Accept, " + views.CSRFHeader},
 			AllowCredentials: true,
 			MaxAge:           12 * time.Hour,
 		}))
 	}
 	r.GET("/ping", views.Pong)
+	r.GET("/.well-known/jwks.json", views.JWKS)
+	r.GET("/.well-known/openid-configuration", oauthProviderRequired(), views.OpenIDConfiguration)
 	r.POST(baseURL+"/user", views.UserRegister)
-	r.POST(baseURL+"/token", authMiddleware.LoginHandler)
+	r.POST(baseURL+"/token", views.LoginHandler)
+	r.POST(baseURL+"/token/refresh", views.RefreshToken)
+	r.POST(baseURL+"/token/totp", views.LoginTOTP)
+	r.POST(baseURL+"/token/passkey/options", views.PasskeyLoginOptions)
+	r.POST(baseURL+"/token/passkey", views.LoginPasskey)
+	r.POST(baseURL+"/token/oidc", views.LoginOIDC)
+	r.POST(baseURL+"/token/magic_link", magicLinkRequired(), views.SendMagicLink)
+	r.POST(baseURL+"/token/magic_link/exchange", magicLinkRequired(), views.LoginMagicLink)
+	r.GET(baseURL+"/oidc", views.GetOIDCProviders)
+	r.GET(baseURL+"/oidc/:provider", views.OIDCAuthorize)
+	r.GET(baseURL+"/captcha", views.CaptchaChallenge)
 	r.POST(baseURL+"/forget_password", views.UserForgetPassword)
 	r.POST(baseURL+"/reset_password", views.UserResetPassword)
 	auth := r.Group(baseURL + "/token")
-	auth.Use(authMiddleware.MiddlewareFunc())
-	auth.GET("", authMiddleware.RefreshHandler)
+	auth.Use(authRequired())
+	auth.GET("", views.RefreshHandler)
+	auth.DELETE("", getUserInfo(), views.Logout)
 	user := r.Group(baseURL + "/user")
-	user.Use(authMiddleware.MiddlewareFunc())
+	user.Use(authRequired())
 	user.Use(getUserInfo())
+	user.Use(sudoRequired())
 	{
 		user.GET("", views.UserInfo)
 		user.PATCH("", views.UserChangeInfo)
-		user.PATCH("/permission", views.ChangeUserPermissions)
+		user.PATCH("/password", notImpersonating(), views.UserChangePassword)
+		user.PATCH("/email", notImpersonating(), views.UserChangeEmail)
+		user.POST("/sudo", views.Sudo)
+		user.PATCH("/permission", notImpersonating(), views.ChangeUserPermissions)
+		user.GET("/lockouts", views.GetLoginLockouts)
+		user.POST("/unlock", notImpersonating(), views.UnlockLogin)
+		user.POST("/totp", notImpersonating(), views.EnrollTOTP)
+		user.POST("/totp/confirm", notImpersonating(), views.ConfirmTOTP)
+		user.DELETE("/totp", notImpersonating(), views.DisableTOTP)
+		user.POST("/totp/recovery_codes", notImpersonating(), views.RegenerateRecoveryCodes)
+		user.DELETE("/trusted_devices", notImpersonating(), views.ForgetTrustedDevices)
+		user.GET("/sessions", views.GetSessions)
+		user.DELETE("/sessions", notImpersonating(), views.DeleteSessions)
+		user.DELETE("/sessions/:id", notImpersonating(), views.DeleteSession)
+		user.GET("/logins", views.GetLoginHistory)
+		user.POST("/tokens", notImpersonating(), views.CreatePersonalAccessToken)
+		user.GET("/tokens", views.GetPersonalAccessTokens)
+		user.DELETE("/tokens/:id", notImpersonating(), views.DeletePersonalAccessToken)
+		user.POST("/passkeys/options", notImpersonating(), views.PasskeyRegisterOptions)
+		user.POST("/passkeys", notImpersonating(), views.RegisterPasskey)
+		user.GET("/passkeys", views.GetPasskeys)
+		user.DELETE("/passkeys/:id", notImpersonating(), views.DeletePasskey)
+		user.GET("/identities", views.GetExternalIdentities)
+		user.DELETE("/identities/:id", notImpersonating(), views.DeleteExternalIdentity)
+		user.GET("/oauth/consents", views.GetOAuthConsents)
+		user.DELETE("/oauth/consents/:client_id", notImpersonating(), views.DeleteOAuthConsent)
+		user.POST("/impersonate", notImpersonating(), views.StartImpersonation)
+		user.DELETE("/impersonate", views.StopImpersonation)
+		user.GET("/audit_logs", views.GetAuditLogs)
+	}
+	oauthClient := r.Group(baseURL + "/oauth")
+	oauthClient.Use(oauthProviderRequired())
+	{
+		oauthClient.POST("/token", views.OAuthToken)
+		oauthClient.GET("/userinfo", views.OAuthUserInfo)
+		oauthClient.POST("/userinfo", views.OAuthUserInfo)
+	}
+	oauth := r.Group(baseURL + "/oauth")
+	oauth.Use(oauthProviderRequired())
+	oauth.Use(authRequired())
+	oauth.Use(getUserInfo())
+	oauth.Use(sudoRequired())
+	{
+		oauth.GET("/authorize", views.GetOAuthAuthorization)
+		oauth.POST("/authorize", notImpersonating(), views.OAuthAuthorize)
+		oauth.POST("/clients", notImpersonating(), views.CreateOAuthClient)
+		oauth.GET("/clients", views.GetOAuthClients)
+		oauth.DELETE("/clients/:client_id", notImpersonating(), views.DeleteOAuthClient)
 	}
 	username := r.Group(baseURL + "/username")
-	username.Use(authMiddleware.MiddlewareFunc())
+	username.Use(authRequired())
+	username.Use(getUserInfo())
 	{
 		username.POST("", views.GetUserName)
 	}
-	usernamePrivate := r.Group(privateBaseURL + "/username")
+	private := r.Group(privateBaseURL)
+	private.Use(serviceRequired())
+	private.POST("/introspect", views.IntrospectToken)
+	usernamePrivate := private.Group("/username")
 	{
 		usernamePrivate.POST("", views.GetUserName)
 	}
 	getannouncement := r.Group(baseURL + "/announcements")
 	getannouncement.GET("", views.GetAllAnnouncements)
 	announcement := r.Group(baseURL + "/announcements")
-	announcement.Use(authMiddleware.MiddlewareFunc())
+	announcement.Use(authRequired())
 	announcement.Use(getUserInfo())
 	{
 		announcement.POST("", views.CreateAnnouncement)
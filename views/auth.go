@@ -0,0 +1,185 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"gorm.io/gorm"
+)
+
+var errWrongCredentials = errors.New("username or password is wrong")
+
+// Authenticator 以帳號密碼驗證使用者的後端
+type Authenticator interface {
+	// Name 後端名稱，也是這個後端建立的使用者的 AuthBackend
+	Name() string
+	// Authenticate 驗證成功時回傳對應的本地使用者，帳號密碼錯誤時回傳 errWrongCredentials
+	Authenticate(username, password string) (*models.User, error)
+}
+
+// 依序嘗試的驗證後端
+var authenticators []Authenticator
+
+// setupAuthenticators 依 AUTH_BACKENDS 設定驗證後端，預設只有本地帳號
+func setupAuthenticators() {
+	backends := os.Getenv("AUTH_BACKENDS")
+	if backends == "" {
+		backends = "local"
+	}
+
+	authenticators = nil
+	for _, name := range strings.Split(backends, ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			authenticators = append(authenticators, localAuthenticator{})
+		case "ldap":
+			authenticators = append(authenticators, newLDAPAuthenticator())
+		default:
+			log.Fatal("Auth Error: unknown backend " + name)
+		}
+	}
+}
+
+// authenticate 依序以每個後端驗證，任一後端通過即登入成功
+func authenticate(username, password string) (*models.User, error) {
+	for _, authenticator := range authenticators {
+		user, err := authenticator.Authenticate(username, password)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, errWrongCredentials) {
+			log.Println("Auth Error:", authenticator.Name(), err)
+		}
+	}
+	return nil, errWrongCredentials
+}
+
+// localAuthenticator 以資料庫中的密碼驗證
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string {
+	return ""
+}
+
+func (localAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	user, err := models.UserDetailByUserName(username)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errWrongCredentials
+		}
+		return nil, err
+	}
+	// 其他後端建立的使用者沒有本地密碼
+	if user.AuthBackend != "" || pkg.Compare(user.Password, password) != nil {
+		return nil, errWrongCredentials
+	}
+	return &user, nil
+}
+
+// ldapAuthenticator 以校園目錄服務的密碼驗證，第一次登入時建立本地的 shadow user
+type ldapAuthenticator struct {
+	*pkg.LDAP
+}
+
+func newLDAPAuthenticator() ldapAuthenticator {
+	directory := &pkg.LDAP{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "1",
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		UserDN:             os.Getenv("LDAP_USER_DN"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		EmailAttribute:     os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		NameAttribute:      os.Getenv("LDAP_NAME_ATTRIBUTE"),
+		StudentIDAttribute: os.Getenv("LDAP_STUDENT_ID_ATTRIBUTE"),
+	}
+	if directory.URL == "" || (directory.UserDN == "" && directory.BindDN == "") {
+		log.Fatal("Auth Error: LDAP_URL and LDAP_USER_DN or LDAP_BIND_DN are required")
+	}
+	if directory.BaseDN != "" && directory.UserFilter == "" {
+		directory.UserFilter = "(uid=%s)"
+	}
+	if directory.EmailAttribute == "" {
+		directory.EmailAttribute = "mail"
+	}
+	if directory.NameAttribute == "" {
+		directory.NameAttribute = "displayName"
+	}
+	return ldapAuthenticator{directory}
+}
+
+func (ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+var isValidUserName = regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
+
+// truncate 將字串截斷為資料庫欄位的長度
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+func (a ldapAuthenticator) Authenticate(username, password string) (*models.User, error) {
+	if !isValidUserName(username) || len(username) > 20 {
+		return nil, errWrongCredentials
+	}
+
+	entry, err := a.LDAP.Authenticate(username, password)
+	if err != nil {
+		if errors.Is(err, pkg.ErrLDAPInvalidCredentials) {
+			return nil, errWrongCredentials
+		}
+		return nil, err
+	}
+
+	user, err := models.UserDetailByUserName(username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		// 同名的本地帳號屬於其他人，不能以目錄服務的密碼登入
+		if user.AuthBackend != a.Name() {
+			return nil, errWrongCredentials
+		}
+		return &user, nil
+	}
+
+	// 以外部帳號登入的使用者沒有本地密碼
+	secret, err := pkg.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := pkg.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	user = models.User{
+		UserName:    username,
+		Password:    pwd,
+		RealName:    truncate(entry.Name, 30),
+		StudentID:   truncate(entry.StudentID, 15),
+		AuthBackend: a.Name(),
+	}
+	if len(entry.Email) <= 40 {
+		user.Email = entry.Email
+	}
+	if user.RealName == "" {
+		user.RealName = username
+	}
+	if err := dropTakenIdentifiers(&user); err != nil {
+		return nil, err
+	}
+	if err := models.CreateUser(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,221 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 可以要求 captcha 的 API，同時也是 reCAPTCHA v3 與 Turnstile 的 action
+const (
+	captchaRegister       = "register"
+	captchaLogin          = "login"
+	captchaForgetPassword = "forget_password"
+	captchaMagicLink      = "magic_link"
+)
+
+// hCaptcha 的測試用 secret，搭配測試用的 token 一定會通過
+const hCaptchaTestSecret = "0x0000000000000000000000000000000000000000"
+
+var errCaptchaFailed = errors.New("captcha verification failed")
+
+// CaptchaVerifier 驗證前端取得的 captcha token
+type CaptchaVerifier interface {
+	// Verify token 無效時回傳 errCaptchaFailed，action 為呼叫的 API
+	Verify(token, remoteIP, action string) error
+}
+
+var (
+	captchaVerifier  CaptchaVerifier
+	captchaEndpoints map[string]bool
+	// 登入不在 captchaEndpoints 時，只在可疑的情況要求 captcha
+	adaptiveLoginCaptcha bool
+)
+
+// setupCaptcha 依 CAPTCHA_PROVIDER 設定 captcha 服務，可以是 hcaptcha、recaptcha、turnstile、pow 或 disabled，預設為 hcaptcha，
+// CAPTCHA_ENDPOINTS 以逗號分隔一律需要 captcha 的 API，預設為 register 與 forget_password，
+// 登入不在其中時依 CAPTCHA_ADAPTIVE_LOGIN 只在可疑的情況要求 captcha，設為 0 時關閉
+func setupCaptcha() {
+	provider := os.Getenv("CAPTCHA_PROVIDER")
+	if provider == "" {
+		provider = "hcaptcha"
+	}
+	secret := os.Getenv("CAPTCHA_SECRET")
+
+	switch provider {
+	case "disabled":
+		captchaVerifier = disabledCaptcha{}
+	case "hcaptcha":
+		if secret == "" {
+			secret = os.Getenv("HCAPTCHA_SECRET")
+		}
+		if gin.Mode() == gin.TestMode {
+			secret = hCaptchaTestSecret
+		}
+		captchaVerifier = newSiteVerifyCaptcha(pkg.HCaptchaVerifyURL, secret)
+	case "recaptcha":
+		verifier := newSiteVerifyCaptcha(pkg.ReCAPTCHAVerifyURL, secret)
+		verifier.checkAction = true
+		verifier.minScore = 0.5
+		if env := os.Getenv("CAPTCHA_MIN_SCORE"); env != "" {
+			score, err := strconv.ParseFloat(env, 64)
+			if err != nil || score < 0 || score > 1 {
+				log.Fatal("Captcha Error: CAPTCHA_MIN_SCORE must be between 0 and 1")
+			}
+			verifier.minScore = score
+		}
+		captchaVerifier = verifier
+	case "turnstile":
+		captchaVerifier = newSiteVerifyCaptcha(pkg.TurnstileVerifyURL, secret)
+	case "pow":
+		difficulty := defaultProofOfWorkDifficulty
+		if env := os.Getenv("CAPTCHA_POW_DIFFICULTY"); env != "" {
+			var err error
+			difficulty, err = strconv.Atoi(env)
+			if err != nil || difficulty < 1 || difficulty > 32 {
+				log.Fatal("Captcha Error: CAPTCHA_POW_DIFFICULTY must be between 1 and 32")
+			}
+		}
+		captchaVerifier = proofOfWorkCaptcha{difficulty: difficulty}
+	default:
+		log.Fatal("Captcha Error: unknown provider " + provider)
+	}
+
+	endpoints := os.Getenv("CAPTCHA_ENDPOINTS")
+	if endpoints == "" {
+		endpoints = captchaRegister + "," + captchaForgetPassword
+	}
+	captchaEndpoints = map[string]bool{}
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		switch endpoint = strings.TrimSpace(endpoint); endpoint {
+		case captchaRegister, captchaLogin, captchaForgetPassword, captchaMagicLink:
+			captchaEndpoints[endpoint] = true
+		case "":
+		default:
+			log.Fatal("Captcha Error: unknown endpoint " + endpoint)
+		}
+	}
+	adaptiveLoginCaptcha = os.Getenv("CAPTCHA_ADAPTIVE_LOGIN") != "0"
+}
+
+// checkCaptcha API 有啟用 captcha 時驗證 token
+func checkCaptcha(c *gin.Context, endpoint, token string) error {
+	if !captchaEndpoints[endpoint] {
+		return nil
+	}
+	return captchaVerifier.Verify(token, clientIP(c), endpoint)
+}
+
+// loginCaptchaRequired 登入是否需要 captcha，除了設定為一律需要之外，
+// 帳號或 IP 最近失敗多次，或是從沒有登入成功過的裝置登入時也需要
+func loginCaptchaRequired(c *gin.Context, username, ip string) (bool, error) {
+	if captchaEndpoints[captchaLogin] {
+		return true, nil
+	}
+	if !adaptiveLoginCaptcha {
+		return false, nil
+	}
+
+	targets := map[string]loginThrottlePolicy{
+		accountThrottle.target(username): accountThrottle,
+		ipThrottle.target(ip):            ipThrottle,
+	}
+	for target, policy := range targets {
+		failures, err := loginFailures(target)
+		if err != nil {
+			return false, err
+		}
+		if failures >= policy.captchaAfter {
+			return true, nil
+		}
+	}
+
+	// 不存在的帳號視為新裝置，避免從是否需要 captcha 判斷帳號是否存在
+	user, err := models.UserDetailByUserName(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if isTrustedDevice(c, user.ID) {
+		return false, nil
+	}
+	known, err := models.HasSuccessfulLogin(user.ID, c.GetHeader("User-Agent"))
+	return !known, err
+}
+
+// checkLoginCaptcha 登入需要 captcha 時驗證 token
+func checkLoginCaptcha(c *gin.Context, username, ip, token string) error {
+	required, err := loginCaptchaRequired(c, username, ip)
+	if err != nil || !required {
+		return err
+	}
+	return captchaVerifier.Verify(token, ip, captchaLogin)
+}
+
+// disabledCaptcha 不驗證，所有 token 都通過
+type disabledCaptcha struct{}
+
+func (disabledCaptcha) Verify(token, remoteIP, action string) error {
+	return nil
+}
+
+// siteVerifyCaptcha 以 siteverify API 驗證的 hCaptcha、reCAPTCHA v3 與 Turnstile
+type siteVerifyCaptcha struct {
+	*pkg.Captcha
+	// reCAPTCHA v3 的分數門檻，0 表示不檢查
+	minScore float64
+	// reCAPTCHA v3 一定要檢查 action，Turnstile 只在前端有設定時檢查
+	checkAction bool
+}
+
+func newSiteVerifyCaptcha(url, secret string) *siteVerifyCaptcha {
+	if env := os.Getenv("CAPTCHA_VERIFY_URL"); env != "" {
+		url = env
+	}
+	return &siteVerifyCaptcha{Captcha: &pkg.Captcha{URL: url, Secret: secret}}
+}
+
+func (s *siteVerifyCaptcha) Verify(token, remoteIP, action string) error {
+	if token == "" {
+		return errCaptchaFailed
+	}
+	result, err := s.Captcha.Verify(token, remoteIP)
+	if err != nil {
+		return err
+	}
+	if !result.Success {
+		return errCaptchaFailed
+	}
+	if (s.checkAction || result.Action != "") && result.Action != action {
+		return errCaptchaFailed
+	}
+	if result.Score < s.minScore {
+		return errCaptchaFailed
+	}
+	return nil
+}
+
+// respondCaptchaError 回傳 captcha 驗證失敗，讓前端顯示 captcha 後重試，captcha 服務無法使用時回傳系統錯誤
+func respondCaptchaError(c *gin.Context, err error) {
+	if errors.Is(err, errCaptchaFailed) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message":          err.Error(),
+			"captcha_required": true,
+		})
+		return
+	}
+	log.Println("Captcha Error:", err)
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"message": "Server error",
+	})
+}
@@ -0,0 +1,122 @@
+package views
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	accessTokenCookie  = "access_token"
+	refreshTokenCookie = "refresh_token"
+	csrfCookie         = "csrf_token"
+	// refresh token 只需要送到換發與登出的 API
+	refreshTokenCookiePath = "/api/v1/token"
+	// CSRFHeader 以 cookie 驗證時，會改變狀態的請求需要帶上與 csrf cookie 相同的值
+	CSRFHeader = "X-CSRF-Token"
+)
+
+var (
+	cookieSession  bool
+	cookieSameSite http.SameSite
+	cookieDomain   string
+)
+
+// setupCookieSession COOKIE_SESSION=1 時登入也以 HttpOnly cookie 回傳 token，
+// COOKIE_SAME_SITE 可以是 strict、lax 或 none，預設為 lax，前端與 API 不同網站時需要設為 none
+func setupCookieSession() {
+	cookieSession = os.Getenv("COOKIE_SESSION") == "1"
+	cookieDomain = os.Getenv("COOKIE_DOMAIN")
+	switch sameSite := strings.ToLower(os.Getenv("COOKIE_SAME_SITE")); sameSite {
+	case "", "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		cookieSameSite = http.SameSiteNoneMode
+	default:
+		log.Fatal("Cookie Error: unknown COOKIE_SAME_SITE " + sameSite)
+	}
+}
+
+// CookieAccessToken 啟用 cookie 模式時，取得 cookie 中的 access token
+func CookieAccessToken(c *gin.Context) string {
+	if !cookieSession {
+		return ""
+	}
+	token, _ := c.Cookie(accessTokenCookie)
+	return token
+}
+
+// CheckCSRF 檢查以 cookie 驗證的請求，GET 等不會改變狀態的請求不需要檢查
+func CheckCSRF(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, _ := c.Cookie(csrfCookie)
+	header := c.GetHeader(CSRFHeader)
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// AbortCSRF 回傳 CSRF 檢查失敗
+func AbortCSRF(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"code":    http.StatusForbidden,
+		"message": "csrf token is invalid",
+	})
+}
+
+func setCookie(c *gin.Context, name, value string, maxAge int, path string, httpOnly bool) {
+	// SameSite=None 的 cookie 一定要是 Secure
+	secure := gin.Mode() == gin.ReleaseMode || cookieSameSite == http.SameSiteNoneMode
+	c.SetSameSite(cookieSameSite)
+	c.SetCookie(name, value, maxAge, path, cookieDomain, secure, httpOnly)
+}
+
+// setSessionCookies 啟用 cookie 模式時以 cookie 回傳 token，refreshToken 為空字串時只更新 access token，
+// 登入時產生新的 CSRF token，前端從 cookie 讀取後放在 X-CSRF-Token header
+func setSessionCookies(c *gin.Context, token string, expire time.Time, refreshToken string, login bool) error {
+	if !cookieSession {
+		return nil
+	}
+	setCookie(c, accessTokenCookie, token, int(time.Until(expire).Seconds()), "/", true)
+	if refreshToken == "" {
+		return nil
+	}
+	setCookie(c, refreshTokenCookie, refreshToken, int(refreshTokenLifetime.Seconds()), refreshTokenCookiePath, true)
+
+	csrf, err := c.Cookie(csrfCookie)
+	if login || err != nil || csrf == "" {
+		if csrf, err = pkg.RandomToken(32); err != nil {
+			return err
+		}
+	}
+	setCookie(c, csrfCookie, csrf, int(refreshTokenLifetime.Seconds()), "/", false)
+	return nil
+}
+
+// clearSessionCookies 登出時清除 cookie
+func clearSessionCookies(c *gin.Context) {
+	if !cookieSession {
+		return
+	}
+	setCookie(c, accessTokenCookie, "", -1, "/", true)
+	setCookie(c, refreshTokenCookie, "", -1, refreshTokenCookiePath, true)
+	setCookie(c, csrfCookie, "", -1, "/", false)
+}
+
+// cookieRefreshToken 請求沒有帶 refresh token 時，在 cookie 模式下改用 cookie 中的 refresh token
+func cookieRefreshToken(c *gin.Context) string {
+	if !cookieSession {
+		return ""
+	}
+	token, _ := c.Cookie(refreshTokenCookie)
+	return token
+}
@@ -0,0 +1,84 @@
+package views
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"gorm.io/gorm"
+)
+
+// loginUserName 將 username、email 或學號轉換為 username，找不到時原樣回傳交給其他驗證後端
+func loginUserName(identifier string) (string, error) {
+	var user models.User
+	var err error
+	if strings.Contains(identifier, "@") {
+		user, err = models.UserDetailByEmail(identifier)
+	} else {
+		user, err = models.UserDetailByUserName(identifier)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			user, err = models.UserDetailByStudentID(identifier)
+		}
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return identifier, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return user.UserName, nil
+}
+
+// takenBy 檢查查詢到的使用者是否為 userID 以外的人
+func takenBy(userID uint, user models.User, err error) (bool, error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return user.ID != userID, nil
+}
+
+// identifierTaken 檢查 username、email、學號是否已被其他使用者使用，空字串不檢查
+// 學號與 username 可以互相當作登入帳號，因此兩者也不能重複，與學號相同以不分大小寫比對
+func identifierTaken(userID uint, username, email, studentID string) (string, error) {
+	if username != "" {
+		user, err := models.UserDetailByStudentID(username)
+		if taken, err := takenBy(userID, user, err); err != nil || taken {
+			return "username is already used", err
+		}
+	}
+	if email != "" {
+		user, err := models.UserDetailByEmail(email)
+		if taken, err := takenBy(userID, user, err); err != nil || taken {
+			return "email is already used", err
+		}
+	}
+	if studentID != "" {
+		user, err := models.UserDetailByStudentID(studentID)
+		if taken, err := takenBy(userID, user, err); err != nil || taken {
+			return "student id is already used", err
+		}
+		user, err = models.UserDetailByUserNameFold(studentID)
+		if taken, err := takenBy(userID, user, err); err != nil || taken {
+			return "student id is already used", err
+		}
+	}
+	return "", nil
+}
+
+// dropTakenIdentifiers 外部帳號建立使用者時，清除已被其他使用者使用的 email 與學號
+func dropTakenIdentifiers(user *models.User) error {
+	if message, err := identifierTaken(0, "", user.Email, ""); err != nil {
+		return err
+	} else if message != "" {
+		user.Email = ""
+	}
+	if message, err := identifierTaken(0, "", "", user.StudentID); err != nil {
+		return err
+	} else if message != "" {
+		user.StudentID = ""
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 模擬使用者的 token 有效期限，不能換發
+const impersonationTimeout = 30 * time.Minute
+
+// 稽核紀錄的動作
+const (
+	auditImpersonationStart = "impersonation_start"
+	auditImpersonationStop  = "impersonation_stop"
+)
+
+// Impersonator 正在模擬使用者的管理員，不是模擬時回傳 false
+func Impersonator(c *gin.Context) (uint, bool) {
+	id, ok := ExtractClaims(c)["impersonator"].(string)
+	if !ok {
+		return 0, false
+	}
+	impersonator, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false
+	}
+	return uint(impersonator), true
+}
+
+// audit 記錄管理員的操作，失敗時只記錄在 log，不影響操作本身
+func audit(c *gin.Context, actorID, targetID uint, action, detail string) {
+	err := models.CreateAuditLog(&models.AuditLog{
+		ActorID:  actorID,
+		TargetID: targetID,
+		Action:   action,
+		Detail:   truncate(detail, 1000),
+		IP:       clientIP(c),
+	})
+	if err != nil {
+		log.Println("Audit Error:", action, actorID, targetID, err)
+	}
+}
+
+// StartImpersonation 管理員取得以其他使用者身分檢視的短效 token
+func StartImpersonation(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+	adminID := c.MustGet("userID").(uint)
+
+	var data struct {
+		UserID *uint  `json:"user_id"`
+		Reason string `json:"reason"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.UserID == nil || data.Reason == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	user, err := models.UserDetailByID(*data.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "no such user",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	// 模擬其他管理員等於取得對方的權限
+	if user.ID == adminID || user.Admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "cannot impersonate this user",
+		})
+		return
+	}
+
+	jti, err := pkg.RandomToken(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	expire := time.Now().Add(impersonationTimeout)
+	claims := userClaims(&user)
+	claims["jti"] = jti
+	claims["id"] = strconv.FormatUint(uint64(user.ID), 10)
+	claims["impersonator"] = strconv.FormatUint(uint64(adminID), 10)
+	claims["ver"] = user.TokenVersion
+	claims["exp"] = expire.Unix()
+	token, err := currentKeyRing().Signing().Sign(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	audit(c, adminID, user.ID, auditImpersonationStart, data.Reason)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+// StopImpersonation 結束模擬，撤銷模擬使用者的 token
+func StopImpersonation(c *gin.Context) {
+	impersonator, ok := Impersonator(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "not impersonating",
+		})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+	claims := ExtractClaims(c)
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+
+	err := models.RevokeToken(&models.RevokedToken{
+		JTI:       jti,
+		UserID:    userID,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	audit(c, impersonator, userID, auditImpersonationStop, "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "stop impersonation success",
+	})
+}
+
+// GetAuditLogs 管理員查看稽核紀錄，可以用 user_id 篩選
+func GetAuditLogs(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+
+	var userID uint
+	if query := c.Query("user_id"); query != "" {
+		id, err := strconv.Atoi(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "user id error",
+			})
+			return
+		}
+		userID = uint(id)
+	}
+
+	logs, err := models.GetAuditLogs(userID, 100)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, l := range logs {
+		result = append(result, gin.H{
+			"actor_id":   l.ActorID,
+			"target_id":  l.TargetID,
+			"action":     l.Action,
+			"detail":     l.Detail,
+			"ip":         l.IP,
+			"created_at": l.CreatedAt.Unix(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"audit_logs": result,
+	})
+}
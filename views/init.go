@@ -1,10 +1,8 @@
 package views
 
 import (
+	"log"
 	"os"
-
-	"github.com/gin-gonic/gin"
-	"github.com/meyskens/go-hcaptcha"
 )
 
 var needLog = false
@@ -16,9 +14,22 @@ func Setup() {
 		needLog = true
 	}
 
-	if gin.Mode() == "test" {
-		captchaClient = hcaptcha.New("0x0000000000000000000000000000000000000000")
-		return
+	if err := loadKeyRing(); err != nil {
+		log.Fatal("JWT Error:" + err.Error())
 	}
-	captchaClient = hcaptcha.New(os.Getenv("HCAPTCHA_SECRET"))
+	keyRingReload.Do(func() {
+		go reloadKeyRing()
+	})
+
+	setupOAuth()
+	setupWebAuthn()
+	setupOIDC()
+	setupAuthenticators()
+	setupTrustedProxies()
+	setupPrivateServices()
+	setupSudoRoutes()
+	setupLoginHistory()
+	setupCaptcha()
+	setupMagicLink()
+	setupCookieSession()
 }
@@ -0,0 +1,150 @@
+package views
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// 其他服務最多可以快取查詢結果多久，越短撤銷與權限變更越快生效
+const introspectionCacheTTL = 30 * time.Second
+
+// activeAccessToken 驗證登入取得的 access token，並確認 token 與 session 尚未被撤銷
+func activeAccessToken(token string) (jwt.MapClaims, bool, error) {
+	claims, err := VerifyToken(token)
+	if err != nil {
+		return nil, false, nil
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return nil, false, nil
+	}
+	revoked, err := models.IsTokenRevoked(jti)
+	if err != nil || revoked {
+		return nil, false, err
+	}
+	active, err := CheckSession(claims)
+	if err != nil || !active {
+		return nil, false, err
+	}
+	return claims, true, nil
+}
+
+// activeOAuthAccessToken 驗證簽發給 client 的 access token，並確認使用者尚未撤銷授權
+func activeOAuthAccessToken(token string) (jwt.MapClaims, bool, error) {
+	claims, err := verifyPurposeToken(token, purposeOAuthAccess)
+	if err != nil {
+		return nil, false, nil
+	}
+	userID, err := claimUserID(claims)
+	if err != nil {
+		return nil, false, nil
+	}
+	clientID, _ := claims["aud"].(string)
+	if _, err := models.OAuthConsentByUserClient(userID, clientID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return claims, true, nil
+}
+
+// introspect 依 token 的格式驗證，回傳 token 的種類與 claims
+func introspect(token string) (string, jwt.MapClaims, bool, error) {
+	if strings.HasPrefix(token, PersonalAccessTokenPrefix) {
+		claims, err := VerifyPersonalAccessToken(token)
+		return "personal_access_token", claims, err == nil, nil
+	}
+	if claims, active, err := activeAccessToken(token); err != nil || active {
+		return "access_token", claims, active, err
+	}
+	claims, active, err := activeOAuthAccessToken(token)
+	return "oauth_access_token", claims, active, err
+}
+
+// IntrospectToken 讓其他服務查詢 token 是否仍然有效（RFC 7662），
+// 使用者資訊以目前資料庫中的為準，不是 token 簽發時的內容
+func IntrospectToken(c *gin.Context) {
+	token := c.PostForm("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_request",
+		})
+		return
+	}
+
+	inactive := func() {
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"active": false,
+		})
+	}
+
+	tokenType, claims, active, err := introspect(token)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	if !active {
+		inactive()
+		return
+	}
+
+	user, err := TokenUser(claims)
+	if err != nil {
+		if errors.Is(err, ErrTokenOutdated) {
+			inactive()
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+
+	id := strconv.FormatUint(uint64(user.ID), 10)
+	response := gin.H{
+		"active":     true,
+		"token_type": tokenType,
+		"sub":        id,
+		"id":         id,
+		"username":   user.UserName,
+		"admin":      user.Admin,
+		"teacher":    user.Teacher,
+	}
+	maxAge := introspectionCacheTTL
+	if exp, ok := claims["exp"]; ok {
+		var expire time.Time
+		switch exp := exp.(type) {
+		case float64:
+			expire = time.Unix(int64(exp), 0)
+		case int64:
+			expire = time.Unix(exp, 0)
+		}
+		response["exp"] = expire.Unix()
+		if remaining := time.Until(expire); remaining < maxAge {
+			maxAge = remaining
+		}
+	}
+	for _, key := range []string{"jti", "scope", "impersonator"} {
+		if value, ok := claims[key]; ok {
+			response[key] = value
+		}
+	}
+	if tokenType == "oauth_access_token" {
+		response["client_id"] = claims["aud"]
+	}
+
+	c.Header("Cache-Control", "private, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	c.JSON(http.StatusOK, response)
+}
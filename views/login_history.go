@@ -0,0 +1,146 @@
+package views
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/gin-gonic/gin"
+)
+
+// 預設保留登入紀錄的天數
+const defaultLoginHistoryRetentionDays = 90
+
+// 登入方式
+const (
+	loginMethodPassword     = "password"
+	loginMethodLDAP         = "ldap"
+	loginMethodTOTP         = "totp"
+	loginMethodRecoveryCode = "recovery_code"
+	loginMethodPasskey      = "passkey"
+	loginMethodOIDC         = "oidc"
+	loginMethodMagicLink    = "magic_link"
+)
+
+// 以密碼或兩步驟驗證登入時視為最近驗證過身分，magic link、外部登入與 passkey 登入需要另外以 sudo 驗證
+var elevatingLoginMethods = map[string]bool{
+	loginMethodPassword:     true,
+	loginMethodLDAP:         true,
+	loginMethodTOTP:         true,
+	loginMethodRecoveryCode: true,
+}
+
+// 登入失敗的原因
+const (
+	loginFailureWrongCredentials = "wrong_credentials"
+	loginFailureThrottled        = "throttled"
+	loginFailureWrongCode        = "wrong_code"
+	loginFailureCaptcha          = "captcha_failed"
+	loginFailureInvalidLink      = "invalid_link"
+	loginFailureInvalidToken     = "invalid_token"
+)
+
+// 第一步驗證通過但還需要兩步驟驗證，不算成功登入
+const loginPendingMFA = "mfa_required"
+
+// 密碼登入時記錄使用者輸入的帳號、email 或學號
+const loginIdentifierKey = "loginIdentifier"
+
+var loginHistoryRetention time.Duration
+
+// setupLoginHistory 從 LOGIN_HISTORY_RETENTION_DAYS 讀取登入紀錄保留的天數
+func setupLoginHistory() {
+	days := defaultLoginHistoryRetentionDays
+	if env := os.Getenv("LOGIN_HISTORY_RETENTION_DAYS"); env != "" {
+		var err error
+		days, err = strconv.Atoi(env)
+		if err != nil || days <= 0 {
+			log.Fatal("Login History Error: LOGIN_HISTORY_RETENTION_DAYS must be a positive integer")
+		}
+	}
+	loginHistoryRetention = time.Duration(days) * 24 * time.Hour
+}
+
+// passwordLoginMethod 依使用者的驗證後端判斷以密碼登入的方式
+func passwordLoginMethod(user *models.User) string {
+	if user.AuthBackend == "ldap" {
+		return loginMethodLDAP
+	}
+	return loginMethodPassword
+}
+
+// recordLoginAttempt 記錄一次登入嘗試，reason 為空字串表示成功，失敗時只記錄在 log，不影響登入本身
+func recordLoginAttempt(c *gin.Context, userID uint, identifier, method, reason string) {
+	err := models.CreateLoginAttempt(&models.LoginAttempt{
+		UserID:     userID,
+		Identifier: truncate(identifier, 100),
+		Method:     method,
+		Success:    reason == "",
+		Reason:     reason,
+		IP:         clientIP(c),
+		UserAgent:  c.GetHeader("User-Agent"),
+	}, time.Now().Add(-loginHistoryRetention))
+	if err != nil {
+		log.Println("Login History Error:", identifier, err)
+	}
+}
+
+// recordLoginFailureAttempt 記錄失敗的登入嘗試，帳號存在時記在該使用者底下
+func recordLoginFailureAttempt(c *gin.Context, username, identifier, method, reason string) {
+	var userID uint
+	if user, err := models.UserDetailByUserName(username); err == nil {
+		userID = user.ID
+	}
+	recordLoginAttempt(c, userID, identifier, method, reason)
+}
+
+// GetLoginHistory 列出登入紀錄，管理員可以用 user_id 查看其他使用者
+func GetLoginHistory(c *gin.Context) {
+	userID, ok := sessionOwner(c)
+	if !ok {
+		return
+	}
+
+	limit := 100
+	if query := c.Query("limit"); query != "" {
+		n, err := strconv.Atoi(query)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "limit error",
+			})
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	attempts, err := models.GetLoginAttemptsByUserID(userID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, attempt := range attempts {
+		result = append(result, gin.H{
+			"identifier": attempt.Identifier,
+			"method":     attempt.Method,
+			"success":    attempt.Success,
+			"reason":     attempt.Reason,
+			"ip":         attempt.IP,
+			"device":     deviceName(attempt.UserAgent),
+			"user_agent": attempt.UserAgent,
+			"created_at": attempt.CreatedAt.Unix(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"logins": result,
+	})
+}
@@ -0,0 +1,223 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// 登入連結的有效期限
+	magicLinkTimeout = 10 * time.Minute
+	// 同一個信箱兩封登入連結之間至少間隔的時間
+	magicLinkInterval = time.Minute
+	// 同一個信箱在 loginFailureWindow 內最多可以寄幾封登入連結
+	magicLinkLimit = 5
+)
+
+// magicLinkThrottleTarget 信箱在 login throttle 中的 key，不論帳號是否存在都計算，避免從回應判斷帳號是否存在
+func magicLinkThrottleTarget(email string) string {
+	return "magic_link:" + truncate(strings.ToLower(email), 89)
+}
+
+// magicLinkRetryAfter 同一個信箱寄太多次時回傳 tooManyAttemptsError
+func magicLinkRetryAfter(email string) error {
+	throttle, err := models.LoginThrottleByTarget(magicLinkThrottleTarget(email))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	wait := time.Until(throttle.LastFailureAt.Add(magicLinkInterval))
+	if throttle.Failures >= magicLinkLimit {
+		wait = time.Until(throttle.LastFailureAt.Add(loginFailureWindow))
+	}
+	if wait > 0 {
+		return &tooManyAttemptsError{wait: wait}
+	}
+	return nil
+}
+
+// 前端接收登入連結的頁面，由前端以 POST 換取 token，避免信箱的連結預覽直接使用掉只能使用一次的連結
+var magicLinkURL string
+
+// setupMagicLink 從 MAGIC_LINK_URL 或 FrontendURL 決定登入連結的網址，都沒有設定時不提供 magic link 登入，
+// 不從請求推算網址，避免偽造的 Host 讓信中的連結指向其他網站
+func setupMagicLink() {
+	magicLinkURL = os.Getenv("MAGIC_LINK_URL")
+	if frontend := os.Getenv("FrontendURL"); magicLinkURL == "" && frontend != "" {
+		magicLinkURL = strings.TrimSuffix(strings.Split(frontend, ",")[0], "/") + "/login/magic_link"
+	}
+	if magicLinkURL == "" {
+		return
+	}
+	if link, err := url.Parse(magicLinkURL); err != nil || (link.Scheme != "https" && link.Scheme != "http") || link.Host == "" {
+		log.Fatal("Magic Link Error: MAGIC_LINK_URL must be an absolute URL")
+	}
+}
+
+// MagicLinkEnabled 是否設定了登入連結的網址，提供 magic link 登入
+func MagicLinkEnabled() bool {
+	return magicLinkURL != ""
+}
+
+// SendMagicLink 寄送登入連結，不論信箱是否存在都回傳成功
+func SendMagicLink(c *gin.Context) {
+	var data struct {
+		Email string `json:"email"`
+		// 沒有啟用 captcha 時可以省略
+		CaptchaToken string `json:"captcha_token"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	if err := checkCaptcha(c, captchaMagicLink, data.CaptchaToken); err != nil {
+		respondCaptchaError(c, err)
+		return
+	}
+
+	if err := magicLinkRetryAfter(data.Email); err != nil {
+		var throttled *tooManyAttemptsError
+		if errors.As(err, &throttled) {
+			abortTooManyAttempts(c, throttled)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	since := time.Now().Add(-loginFailureWindow)
+	if _, err := models.RecordLoginFailure(magicLinkThrottleTarget(data.Email), since); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	sent := gin.H{
+		"message": "Email sent",
+	}
+	user, err := models.UserDetailByEmail(data.Email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Magic Link Error:", err)
+		}
+		c.JSON(http.StatusOK, sent)
+		return
+	}
+	if user.Suspended {
+		c.JSON(http.StatusOK, sent)
+		return
+	}
+
+	token, _, err := generatePurposeToken(purposeMagicLink, magicLinkTimeout, jwt.MapClaims{
+		"id":    strconv.FormatUint(uint64(user.ID), 10),
+		"email": strings.ToLower(user.Email),
+		"ver":   user.TokenVersion,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	subject := os.Getenv("MAGIC_LINK_SUBJECT")
+	if subject == "" {
+		subject = "Sign in link"
+	}
+	link := magicLinkURL + "?token=" + url.QueryEscape(token)
+	text := "Use the following link to sign in within " + strconv.Itoa(int(magicLinkTimeout.Minutes())) +
+		" minutes. If you did not request it, you can ignore this email."
+	if err := pkg.SendLink(user.Email, subject, text, link); err != nil {
+		log.Println("Magic Link Error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, sent)
+}
+
+// LoginMagicLink 以登入連結中的 token 登入，回傳與密碼登入相同的結果
+func LoginMagicLink(c *gin.Context) {
+	var data struct {
+		Token string `json:"token"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	invalid := func() {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "magic link is invalid",
+		})
+	}
+
+	claims, err := verifyPurposeToken(data.Token, purposeMagicLink)
+	if err != nil {
+		invalid()
+		return
+	}
+	userID, err := claimUserID(claims)
+	if err != nil {
+		invalid()
+		return
+	}
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		invalid()
+		return
+	}
+	// 寄出之後改了信箱或是 token 被撤銷時，連結失效
+	if claims["email"] != strings.ToLower(user.Email) || claimVersion(claims) != user.TokenVersion {
+		recordLoginAttempt(c, user.ID, user.UserName, loginMethodMagicLink, loginFailureInvalidLink)
+		invalid()
+		return
+	}
+	if err := consumePurposeToken(claims); err != nil {
+		recordLoginAttempt(c, user.ID, user.UserName, loginMethodMagicLink, loginFailureInvalidLink)
+		invalid()
+		return
+	}
+
+	loginWithMFA(c, &user, user.UserName, loginMethodMagicLink)
+}
@@ -0,0 +1,716 @@
+package views
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// authorization code 的有效時間
+	oauthCodeTimeout = time.Minute
+	// 簽發給 client 的 access token 與 ID token 的有效時間
+	oauthTokenTimeout = time.Hour
+)
+
+// client 可以要求的 scope
+var oauthScopes = []string{"openid", "profile", "email"}
+
+// errIDTokenKey 對稱金鑰不能公開，client 無法驗證以它簽署的 ID token
+var errIDTokenKey = errors.New("openid scope requires an RS256 or EdDSA signing key")
+
+// 本服務作為 OpenID provider 的 issuer，未設定時不提供 OAuth 服務
+var oauthIssuerURL string
+
+// setupOAuth 從 OAUTH_ISSUER 讀取固定的 issuer，不能由請求的 Host 決定，否則可以偽造 ID token 的 iss。
+// 已經有 client 卻沒有設定時無法啟動，簽署金鑰為對稱金鑰時提醒設定非對稱金鑰，否則 client 不能要求 openid scope
+func setupOAuth() {
+	oauthIssuerURL = strings.TrimSuffix(os.Getenv("OAUTH_ISSUER"), "/")
+	if oauthIssuerURL == "" {
+		clients, err := models.GetAllOAuthClients()
+		if err != nil {
+			log.Fatal("OAuth Error: ", err)
+		}
+		if len(clients) > 0 {
+			log.Fatal("OAuth Error: OAUTH_ISSUER must be set when OAuth clients exist")
+		}
+		return
+	}
+	if issuer, err := url.Parse(oauthIssuerURL); err != nil || (issuer.Scheme != "https" && issuer.Scheme != "http") || issuer.Host == "" {
+		log.Fatal("OAuth Error: OAUTH_ISSUER must be an absolute URL")
+	}
+	if currentKeyRing().Signing().Symmetric() {
+		log.Println("OAuth: " + errIDTokenKey.Error() + ", set JWT_ALGORITHM or promote an asymmetric key")
+	}
+}
+
+// supportedOAuthScopes 目前可以要求的 scope，簽署金鑰為對稱金鑰時不能簽發 ID token
+func supportedOAuthScopes() []string {
+	if !currentKeyRing().Signing().Symmetric() {
+		return oauthScopes
+	}
+	scopes := []string{}
+	for _, scope := range oauthScopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// OAuthProviderEnabled 是否設定了 OAUTH_ISSUER，提供 OAuth 與 OpenID Connect 服務
+func OAuthProviderEnabled() bool {
+	return oauthIssuerURL != ""
+}
+
+// oauthIssuer 本服務作為 OpenID provider 的 issuer
+func oauthIssuer() string {
+	return oauthIssuerURL
+}
+
+// oauthAuthorizeURL 前端的授權同意頁面
+func oauthAuthorizeURL() string {
+	if authorizeURL := os.Getenv("OAUTH_AUTHORIZE_URL"); authorizeURL != "" {
+		return authorizeURL
+	}
+	if frontend := os.Getenv("FrontendURL"); frontend != "" {
+		return strings.TrimSuffix(strings.Split(frontend, ",")[0], "/") + "/oauth/authorize"
+	}
+	return oauthIssuer() + "/oauth/authorize"
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenIDConfiguration OpenID Connect discovery
+func OpenIDConfiguration(c *gin.Context) {
+	issuer := oauthIssuer()
+	algorithms := []string{}
+	if signing := currentKeyRing().Signing(); !signing.Symmetric() {
+		algorithms = append(algorithms, signing.Algorithm)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                oauthAuthorizeURL(),
+		"token_endpoint":                        issuer + "/api/v1/oauth/token",
+		"userinfo_endpoint":                     issuer + "/api/v1/oauth/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"scopes_supported":                      supportedOAuthScopes(),
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": algorithms,
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"claims_supported": []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"username", "admin", "teacher", "name", "preferred_username", "picture", "email",
+		},
+	})
+}
+
+// CreateOAuthClient 管理員註冊 client，沒有 secret 的 public client 必須使用 PKCE
+func CreateOAuthClient(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+	userID := c.MustGet("userID").(uint)
+
+	var data struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Name == "" || len(data.RedirectURIs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	for _, redirectURI := range data.RedirectURIs {
+		u, err := url.Parse(redirectURI)
+		if !isValidURL(redirectURI) || err != nil || u.Fragment != "" || strings.ContainsAny(redirectURI, " \n") {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "redirect uri is invalid",
+			})
+			return
+		}
+	}
+
+	clientID, err1 := pkg.RandomToken(16)
+	secret, err2 := pkg.RandomToken(32)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	client := models.OAuthClient{
+		ClientID:     clientID,
+		Name:         data.Name,
+		RedirectURIs: strings.Join(data.RedirectURIs, " "),
+		OwnerID:      userID,
+	}
+	if data.Public {
+		secret = ""
+	} else {
+		client.SecretHash = pkg.HashToken(secret)
+	}
+
+	if err := models.CreateOAuthClient(&client); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":       "client registered",
+		"client_id":     client.ClientID,
+		"client_secret": secret,
+	})
+}
+
+// GetOAuthClients 管理員列出所有 client
+func GetOAuthClients(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+
+	clients, err := models.GetAllOAuthClients()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, client := range clients {
+		result = append(result, gin.H{
+			"client_id":     client.ClientID,
+			"name":          client.Name,
+			"redirect_uris": strings.Fields(client.RedirectURIs),
+			"public":        client.SecretHash == "",
+			"created_at":    client.CreatedAt.Unix(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"clients": result,
+	})
+}
+
+// DeleteOAuthClient 管理員刪除 client
+func DeleteOAuthClient(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+
+	deleted, err := models.DeleteOAuthClient(c.Params.ByName("client_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "client not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "delete client success",
+	})
+}
+
+// authorizeRequest 授權請求的參數，GET 由 query string 傳入，POST 由 JSON 傳入
+type authorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Approve             bool   `form:"-" json:"approve"`
+}
+
+// redirect 產生導回 client 的網址
+func (r *authorizeRequest) redirect(params url.Values) string {
+	if r.State != "" {
+		params.Set("state", r.State)
+	}
+	separator := "?"
+	if strings.Contains(r.RedirectURI, "?") {
+		separator = "&"
+	}
+	return r.RedirectURI + separator + params.Encode()
+}
+
+// validate 檢查授權請求，client 或 redirect uri 錯誤時不能導回 client，回傳 ok 為 false
+func (r *authorizeRequest) validate(c *gin.Context) (client models.OAuthClient, scopes []string, ok bool) {
+	client, err := models.OAuthClientByClientID(r.ClientID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	redirectURIs := strings.Fields(client.RedirectURIs)
+	if r.RedirectURI == "" && len(redirectURIs) == 1 {
+		r.RedirectURI = redirectURIs[0]
+	}
+	if err != nil || !hasScope(redirectURIs, r.RedirectURI) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "client_id or redirect_uri is invalid",
+		})
+		return
+	}
+
+	fail := func(code, description string) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message":      description,
+			"error":        code,
+			"redirect_uri": r.redirect(url.Values{"error": {code}, "error_description": {description}}),
+		})
+	}
+	if r.ResponseType != "code" {
+		fail("unsupported_response_type", "only response_type=code is supported")
+		return
+	}
+	scopes = strings.Fields(r.Scope)
+	for _, scope := range scopes {
+		if scope == "openid" && !hasScope(supportedOAuthScopes(), scope) {
+			fail("invalid_scope", errIDTokenKey.Error())
+			return
+		}
+		if !hasScope(oauthScopes, scope) {
+			fail("invalid_scope", "scope "+scope+" is not supported")
+			return
+		}
+	}
+	if r.CodeChallenge != "" && r.CodeChallengeMethod != "S256" {
+		fail("invalid_request", "code_challenge_method must be S256")
+		return
+	}
+	if r.CodeChallenge == "" && client.SecretHash == "" {
+		fail("invalid_request", "public client must use PKCE")
+		return
+	}
+	ok = true
+	return
+}
+
+// GetOAuthAuthorization 前端顯示授權同意頁面前取得 client 資訊，使用者同意過相同 scope 時不需要再詢問
+func GetOAuthAuthorization(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var request authorizeRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "query format error",
+		})
+		return
+	}
+
+	client, scopes, ok := request.validate(c)
+	if !ok {
+		return
+	}
+
+	consentRequired := true
+	consent, err := models.OAuthConsentByUserClient(userID, client.ClientID)
+	if err == nil {
+		granted := strings.Fields(consent.Scope)
+		consentRequired = false
+		for _, scope := range scopes {
+			consentRequired = consentRequired || !hasScope(granted, scope)
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"client": gin.H{
+			"client_id": client.ClientID,
+			"name":      client.Name,
+		},
+		"scopes":           scopes,
+		"redirect_uri":     request.RedirectURI,
+		"consent_required": consentRequired,
+	})
+}
+
+// OAuthAuthorize 使用者同意或拒絕授權，回傳導回 client 的網址
+func OAuthAuthorize(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var request authorizeRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	client, scopes, ok := request.validate(c)
+	if !ok {
+		return
+	}
+
+	if !request.Approve {
+		c.JSON(http.StatusOK, gin.H{
+			"redirect_uri": request.redirect(url.Values{"error": {"access_denied"}}),
+		})
+		return
+	}
+
+	// 保留之前同意過的 scope
+	granted := scopes
+	if consent, err := models.OAuthConsentByUserClient(userID, client.ClientID); err == nil {
+		for _, scope := range strings.Fields(consent.Scope) {
+			if !hasScope(granted, scope) {
+				granted = append(granted, scope)
+			}
+		}
+	}
+	if err := models.SaveOAuthConsent(userID, client.ClientID, strings.Join(granted, " ")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	code, err := pkg.RandomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	// auth_time 為使用者登入的時間，即 session 建立的時間，不受換發 token 影響
+	now := time.Now()
+	authTime := now
+	if sid, ok := ExtractClaims(c)["sid"].(string); ok {
+		session, err := models.SessionBySID(sid)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+		if err == nil {
+			authTime = session.CreatedAt
+		}
+	}
+	if err := models.CreateOAuthAuthorizationCode(&models.OAuthAuthorizationCode{
+		CodeHash:      pkg.HashToken(code),
+		ClientID:      client.ClientID,
+		UserID:        userID,
+		RedirectURI:   request.RedirectURI,
+		Scope:         strings.Join(scopes, " "),
+		Nonce:         request.Nonce,
+		CodeChallenge: request.CodeChallenge,
+		AuthTime:      authTime,
+		ExpiresAt:     now.Add(oauthCodeTimeout),
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"redirect_uri": request.redirect(url.Values{"code": {code}}),
+	})
+}
+
+// oauthError token endpoint 依 RFC 6749 回傳錯誤
+func oauthError(c *gin.Context, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="NCNUOJ"`)
+	}
+	c.JSON(status, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// authenticateOAuthClient 以 client_secret_basic、client_secret_post 或 public client 的 client_id 驗證 client
+func authenticateOAuthClient(c *gin.Context) (client models.OAuthClient, ok bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, err := models.OAuthClientByClientID(clientID)
+	if err != nil {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if client.SecretHash == "" {
+		ok = secret == ""
+	} else {
+		ok = subtle.ConstantTimeCompare([]byte(pkg.HashToken(secret)), []byte(client.SecretHash)) == 1
+	}
+	if !ok {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+	}
+	return
+}
+
+// OAuthToken token endpoint，以 authorization code 換取 access token 與 ID token
+func OAuthToken(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := authenticateOAuthClient(c)
+	if !ok {
+		return
+	}
+	if c.PostForm("grant_type") != "authorization_code" {
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	code, err := models.ConsumeOAuthAuthorizationCode(pkg.HashToken(c.PostForm("code")))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "code is invalid or expired")
+			return
+		}
+		oauthError(c, http.StatusInternalServerError, "server_error", "Server error")
+		return
+	}
+	if code.ClientID != client.ClientID || code.RedirectURI != c.PostForm("redirect_uri") {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "code is invalid or expired")
+		return
+	}
+	if code.CodeChallenge != "" && pkg.PKCEChallenge(c.PostForm("code_verifier")) != code.CodeChallenge {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "code_verifier is invalid")
+		return
+	}
+
+	user, err := models.UserDetailByID(code.UserID)
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "user does not exist")
+		return
+	}
+	if user.Suspended {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", errAccountSuspended.Error())
+		return
+	}
+	// 使用者在 client 換取 token 之前撤銷授權
+	if _, err := models.OAuthConsentByUserClient(user.ID, client.ClientID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "consent has been revoked")
+			return
+		}
+		oauthError(c, http.StatusInternalServerError, "server_error", "Server error")
+		return
+	}
+
+	id := strconv.FormatUint(uint64(user.ID), 10)
+	accessToken, _, err := generatePurposeToken(purposeOAuthAccess, oauthTokenTimeout, jwt.MapClaims{
+		"id":    id,
+		"ver":   user.TokenVersion,
+		"aud":   client.ClientID,
+		"scope": code.Scope,
+	})
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "Server error")
+		return
+	}
+	response := gin.H{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(oauthTokenTimeout.Seconds()),
+		"scope":        code.Scope,
+	}
+
+	scopes := strings.Fields(code.Scope)
+	if hasScope(scopes, "openid") {
+		// 授權之後才改為對稱金鑰
+		signing := currentKeyRing().Signing()
+		if signing.Symmetric() {
+			oauthError(c, http.StatusInternalServerError, "server_error", errIDTokenKey.Error())
+			return
+		}
+		now := time.Now()
+		claims := oauthUserClaims(&user, scopes)
+		claims["iss"] = oauthIssuer()
+		claims["aud"] = client.ClientID
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(oauthTokenTimeout).Unix()
+		claims["auth_time"] = code.AuthTime.Unix()
+		if code.Nonce != "" {
+			claims["nonce"] = code.Nonce
+		}
+		idToken, err := signing.Sign(claims)
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Server error")
+			return
+		}
+		response["id_token"] = idToken
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// oauthUserClaims 依 scope 提供給 client 的使用者資訊
+func oauthUserClaims(user *models.User, scopes []string) jwt.MapClaims {
+	claims := userClaims(user)
+	claims["sub"] = strconv.FormatUint(uint64(user.ID), 10)
+	if hasScope(scopes, "profile") {
+		claims["name"] = user.RealName
+		claims["preferred_username"] = user.UserName
+		if user.Avatar != "" {
+			claims["picture"] = user.Avatar
+		}
+	}
+	if hasScope(scopes, "email") && user.Email != "" {
+		claims["email"] = user.Email
+	}
+	return claims
+}
+
+// OAuthUserInfo userinfo endpoint，以 client 取得的 access token 查詢使用者資訊
+func OAuthUserInfo(c *gin.Context) {
+	invalid := func() {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error": "invalid_token",
+		})
+	}
+	parts := strings.SplitN(c.GetHeader("Authorization"), " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		invalid()
+		return
+	}
+	// 與 introspection 相同，使用者撤銷授權或帳號停用後 token 失效
+	claims, active, err := activeOAuthAccessToken(parts[1])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+	if !active {
+		invalid()
+		return
+	}
+	user, err := TokenUser(claims)
+	if errors.Is(err, ErrTokenOutdated) {
+		invalid()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "server_error",
+		})
+		return
+	}
+
+	scope, _ := claims["scope"].(string)
+	c.JSON(http.StatusOK, oauthUserClaims(user, strings.Fields(scope)))
+}
+
+// GetOAuthConsents 列出使用者授權過的 client
+func GetOAuthConsents(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	consents, err := models.GetOAuthConsentsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, consent := range consents {
+		client, err := models.OAuthClientByClientID(consent.ClientID)
+		if err != nil {
+			continue
+		}
+		result = append(result, gin.H{
+			"client_id":  client.ClientID,
+			"name":       client.Name,
+			"scopes":     strings.Fields(consent.Scope),
+			"updated_at": consent.UpdatedAt.Unix(),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"consents": result,
+	})
+}
+
+// DeleteOAuthConsent 撤銷對 client 的授權，下次登入需要重新同意
+func DeleteOAuthConsent(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	deleted, err := models.DeleteOAuthConsent(userID, c.Params.ByName("client_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "consent not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "delete consent success",
+	})
+}
@@ -0,0 +1,449 @@
+package views
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// 從取得授權網址到完成登入的時間
+const oidcTimeout = 10 * time.Minute
+
+// externalProvider 外部登入使用的協定，OpenID Connect 或 GitHub 這類只有 OAuth2 的服務
+type externalProvider interface {
+	AuthCodeURL(state, nonce, verifier string) (string, error)
+	Exchange(code, verifier, nonce string) (*pkg.OIDCClaims, error)
+}
+
+// oidcProvider 外部登入的 provider 與帳號綁定規則
+type oidcProvider struct {
+	externalProvider
+	Name        string
+	DisplayName string
+	// 外部帳號的 email 已驗證時，綁定到 email 相同的既有帳號
+	LinkEmail bool
+	// 找不到對應的帳號時自動建立
+	AutoCreate bool
+}
+
+var oidcProviders map[string]*oidcProvider
+
+var errAccountNotLinked = errors.New("account is not linked")
+
+// setupOIDC 從環境變數讀取 OIDC_PROVIDERS 列出的 provider，每個 provider 以 OIDC_<NAME>_ 開頭設定，
+// TYPE 預設為 oidc，GitHub 沒有 discovery 需要設為 github，ISSUER 與 API_URL 只有 GitHub Enterprise Server 需要設定
+func setupOIDC() {
+	oidcProviders = map[string]*oidcProvider{}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		issuer := os.Getenv(prefix + "ISSUER")
+		clientID := os.Getenv(prefix + "CLIENT_ID")
+		clientSecret := os.Getenv(prefix + "CLIENT_SECRET")
+		redirectURL := os.Getenv(prefix + "REDIRECT_URL")
+		scopes := strings.Fields(os.Getenv(prefix + "SCOPES"))
+		provider := &oidcProvider{
+			Name:        name,
+			DisplayName: os.Getenv(prefix + "DISPLAY_NAME"),
+			LinkEmail:   os.Getenv(prefix+"LINK_EMAIL") == "1",
+			AutoCreate:  os.Getenv(prefix+"AUTO_CREATE") == "1",
+		}
+		if clientID == "" || redirectURL == "" {
+			log.Println("OIDC: provider " + name + " is not complete")
+			continue
+		}
+		switch kind := os.Getenv(prefix + "TYPE"); kind {
+		case "", "oidc":
+			if issuer == "" {
+				log.Println("OIDC: provider " + name + " is not complete")
+				continue
+			}
+			if len(scopes) == 0 {
+				scopes = []string{"openid", "email", "profile"}
+			}
+			provider.externalProvider = &pkg.OIDCProvider{
+				Issuer:       issuer,
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				RedirectURL:  redirectURL,
+				Scopes:       scopes,
+			}
+		case "github":
+			if len(scopes) == 0 {
+				scopes = []string{"read:user", "user:email"}
+			}
+			provider.externalProvider = &pkg.GitHubProvider{
+				URL:          issuer,
+				APIURL:       os.Getenv(prefix + "API_URL"),
+				ClientID:     clientID,
+				ClientSecret: clientSecret,
+				RedirectURL:  redirectURL,
+				Scopes:       scopes,
+			}
+		default:
+			log.Println("OIDC: provider " + name + " has unknown type " + kind)
+			continue
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = name
+		}
+		oidcProviders[name] = provider
+	}
+}
+
+// GetOIDCProviders 列出可以用來登入的外部 provider
+func GetOIDCProviders(c *gin.Context) {
+	providers := []gin.H{}
+	for _, provider := range oidcProviders {
+		providers = append(providers, gin.H{
+			"name":         provider.Name,
+			"display_name": provider.DisplayName,
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i]["name"].(string) < providers[j]["name"].(string)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"providers": providers,
+	})
+}
+
+// OIDCAuthorize 產生導向 provider 的授權網址，state、nonce 與 PKCE verifier 放在 session token 中
+func OIDCAuthorize(c *gin.Context) {
+	provider, ok := oidcProviders[c.Params.ByName("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "provider not found",
+		})
+		return
+	}
+
+	state, err1 := pkg.RandomToken(16)
+	nonce, err2 := pkg.RandomToken(16)
+	verifier, err3 := pkg.RandomToken(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	authorizationURL, err := provider.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"message": "provider is unavailable",
+		})
+		return
+	}
+
+	session, expire, err := generatePurposeToken(purposeOIDC, oidcTimeout, jwt.MapClaims{
+		"provider": provider.Name,
+		"state":    state,
+		"nonce":    nonce,
+		"verifier": verifier,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session":           session,
+		"authorization_url": authorizationURL,
+		"expire":            expire.Format(time.RFC3339),
+	})
+}
+
+var invalidUserNameRunes = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// availableUserName 以外部帳號的名稱產生尚未被使用的 username
+func availableUserName(claims *pkg.OIDCClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	base = invalidUserNameRunes.ReplaceAllString(base, "")
+	if len(base) > 14 {
+		base = base[:14]
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	name := base
+	for i := 0; i < 10; i++ {
+		_, err := models.UserDetailByUserName(name)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", err
+		}
+		if err != nil {
+			message, err := identifierTaken(0, name, "", "")
+			if err != nil {
+				return "", err
+			}
+			if message == "" {
+				return name, nil
+			}
+		}
+		suffix, err := pkg.RandomCode(6)
+		if err != nil {
+			return "", err
+		}
+		name = base + suffix
+	}
+	return "", errors.New("no username available")
+}
+
+// oidcUser 找出外部帳號對應的使用者，依 provider 設定以 email 綁定既有帳號或自動建立帳號
+func oidcUser(provider *oidcProvider, claims *pkg.OIDCClaims) (*models.User, error) {
+	now := time.Now()
+	identity, err := models.ExternalIdentityByProviderSubject(provider.Name, claims.Subject)
+	if err == nil {
+		identity.Email = claims.Email
+		identity.LastUsedAt = &now
+		if err := models.UpdateExternalIdentity(&identity); err != nil {
+			return nil, err
+		}
+		return &identity.User, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	identity = models.ExternalIdentity{
+		Provider:   provider.Name,
+		Subject:    claims.Subject,
+		Email:      claims.Email,
+		LastUsedAt: &now,
+	}
+	// 未驗證的 email 可能屬於別人，不能用來綁定帳號
+	verifiedEmail := ""
+	if claims.EmailVerified {
+		verifiedEmail = claims.Email
+	}
+
+	if provider.LinkEmail && verifiedEmail != "" {
+		user, err := models.UserDetailByEmail(verifiedEmail)
+		if err == nil {
+			identity.UserID = user.ID
+			if err := models.CreateExternalIdentity(&identity); err != nil {
+				return nil, err
+			}
+			return &user, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if !provider.AutoCreate {
+		return nil, errAccountNotLinked
+	}
+
+	userName, err := availableUserName(claims)
+	if err != nil {
+		return nil, err
+	}
+	// 以外部帳號登入的使用者沒有密碼，需要時可以透過忘記密碼設定
+	secret, err := pkg.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	pwd, err := pkg.Encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	realName := []rune(claims.Name)
+	if len(realName) == 0 {
+		realName = []rune(userName)
+	}
+	if len(realName) > 30 {
+		realName = realName[:30]
+	}
+	if len(verifiedEmail) > 40 {
+		verifiedEmail = ""
+	}
+	user := models.User{
+		UserName: userName,
+		RealName: string(realName),
+		Email:    verifiedEmail,
+		Password: pwd,
+	}
+	if isValidURL(claims.Picture) {
+		user.Avatar = claims.Picture
+	}
+	if err := dropTakenIdentifiers(&user); err != nil {
+		return nil, err
+	}
+	if err := models.CreateUserWithExternalIdentity(&user, &identity); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// LoginOIDC 以 provider 回傳的 authorization code 登入
+func LoginOIDC(c *gin.Context) {
+	var data struct {
+		Session string `json:"session"`
+		Code    string `json:"code"`
+		State   string `json:"state"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Session == "" || data.Code == "" || data.State == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	claims, err := verifyPurposeToken(data.Session, purposeOIDC)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "session is invalid",
+		})
+		return
+	}
+	state, _ := claims["state"].(string)
+	if subtle.ConstantTimeCompare([]byte(state), []byte(data.State)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "state is invalid",
+		})
+		return
+	}
+	name, _ := claims["provider"].(string)
+	provider, ok := oidcProviders[name]
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "session is invalid",
+		})
+		return
+	}
+	if err := consumePurposeToken(claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "session is invalid",
+		})
+		return
+	}
+
+	verifier, _ := claims["verifier"].(string)
+	nonce, _ := claims["nonce"].(string)
+	external, err := provider.Exchange(data.Code, verifier, nonce)
+	if err != nil {
+		if needLog {
+			log.Println("OIDC:", provider.Name, err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "external login failed",
+		})
+		return
+	}
+
+	user, err := oidcUser(provider, external)
+	if errors.Is(err, errAccountNotLinked) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    http.StatusForbidden,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	loginWithMFA(c, user, user.UserName, loginMethodOIDC)
+}
+
+// GetExternalIdentities 列出使用者綁定的外部帳號
+func GetExternalIdentities(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	identities, err := models.GetExternalIdentitiesByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, identity := range identities {
+		var lastUsedAt interface{}
+		if identity.LastUsedAt != nil {
+			lastUsedAt = identity.LastUsedAt.Unix()
+		}
+		result = append(result, gin.H{
+			"identity_id":  identity.ID,
+			"provider":     identity.Provider,
+			"email":        identity.Email,
+			"created_at":   identity.CreatedAt.Unix(),
+			"last_used_at": lastUsedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"identities": result,
+	})
+}
+
+// DeleteExternalIdentity 解除綁定外部帳號
+func DeleteExternalIdentity(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "identity id error",
+		})
+		return
+	}
+
+	deleted, err := models.DeleteExternalIdentity(userID, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "identity not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "delete identity success",
+	})
+}
@@ -0,0 +1,212 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/vincentinttsh/zero"
+)
+
+// PersonalAccessTokenPrefix personal access token 的前綴，用來與 JWT 區分，也方便掃描外流的 token
+const PersonalAccessTokenPrefix = "ncnuoj_pat_"
+
+// personal access token 可以申請的 scope
+var personalAccessTokenScopes = map[string]bool{
+	"read:user":           true,
+	"write:user":          true,
+	"write:announcements": true,
+}
+
+// VerifyPersonalAccessToken 驗證 personal access token，回傳與 access token 相同格式的 claims，
+// 使用者的權限以目前資料庫中的為準，建立後使用者改過密碼或權限的 token 視為已撤銷
+func VerifyPersonalAccessToken(token string) (jwt.MapClaims, error) {
+	stored, err := models.PersonalAccessTokenByHash(pkg.HashToken(token))
+	if err != nil {
+		return nil, errors.New("token is invalid")
+	}
+	if stored.TokenVersion != stored.User.TokenVersion {
+		return nil, errors.New("token is revoked")
+	}
+
+	now := time.Now()
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) > sessionTouchInterval {
+		if err := models.TouchPersonalAccessToken(stored.ID, now); err != nil {
+			log.Println("Token Error:", err)
+		}
+	}
+
+	claims := userClaims(&stored.User)
+	claims["id"] = strconv.FormatUint(uint64(stored.UserID), 10)
+	claims["scope"] = stored.Scopes
+	claims["ver"] = stored.TokenVersion
+	if stored.ExpiresAt != nil {
+		claims["exp"] = stored.ExpiresAt.Unix()
+	}
+	return claims, nil
+}
+
+// HasScope 檢查 personal access token 的 claims 是否包含 scope
+func HasScope(claims jwt.MapClaims, scope string) bool {
+	scopes, _ := claims["scope"].(string)
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreatePersonalAccessToken 建立 personal access token，token 只在建立時回傳一次
+func CreatePersonalAccessToken(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var data struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays *int     `json:"expires_in_days"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if zero.IsZero(data.Name) || len(data.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	for _, scope := range data.Scopes {
+		if !personalAccessTokenScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "unknown scope " + scope,
+			})
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if data.ExpiresInDays != nil {
+		if *data.ExpiresInDays <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "expires_in_days must be positive",
+			})
+			return
+		}
+		expire := time.Now().AddDate(0, 0, *data.ExpiresInDays)
+		expiresAt = &expire
+	}
+
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	secret, err := pkg.RandomToken(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	token := PersonalAccessTokenPrefix + secret
+	stored := models.PersonalAccessToken{
+		UserID:       userID,
+		Name:         truncate(data.Name, 50),
+		TokenHash:    pkg.HashToken(token),
+		Scopes:       strings.Join(data.Scopes, " "),
+		ExpiresAt:    expiresAt,
+		TokenVersion: user.TokenVersion,
+	}
+	if err := models.CreatePersonalAccessToken(&stored); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "create token success",
+		"token_id": stored.ID,
+		"token":    token,
+	})
+}
+
+// GetPersonalAccessTokens 列出使用者的 personal access token
+func GetPersonalAccessTokens(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	tokens, err := models.GetPersonalAccessTokensByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	result := []gin.H{}
+	for _, token := range tokens {
+		var expiresAt, lastUsedAt interface{}
+		if token.ExpiresAt != nil {
+			expiresAt = token.ExpiresAt.Unix()
+		}
+		if token.LastUsedAt != nil {
+			lastUsedAt = token.LastUsedAt.Unix()
+		}
+		result = append(result, gin.H{
+			"token_id":     token.ID,
+			"name":         token.Name,
+			"scopes":       strings.Fields(token.Scopes),
+			"created_at":   token.CreatedAt.Unix(),
+			"expires_at":   expiresAt,
+			"last_used_at": lastUsedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tokens": result,
+	})
+}
+
+// DeletePersonalAccessToken 撤銷 personal access token
+func DeletePersonalAccessToken(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "token id error",
+		})
+		return
+	}
+
+	deleted, err := models.DeletePersonalAccessToken(userID, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "token not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "revoke token success",
+	})
+}
@@ -0,0 +1,88 @@
+package views
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	// 預設的難度，瀏覽器平均需要計算 2^20 次，大約一秒
+	defaultProofOfWorkDifficulty = 20
+	// 題目的有效期限，使用過的題目記錄到期限為止
+	proofOfWorkTimeout = 2 * time.Minute
+)
+
+// proofOfWorkCaptcha 不依賴第三方服務的 captcha，伺服器簽發題目，
+// 前端找出 nonce 使 SHA-256(題目:nonce) 開頭有足夠的 0，token 格式為 題目:nonce
+type proofOfWorkCaptcha struct {
+	difficulty int
+}
+
+func (p proofOfWorkCaptcha) Verify(token, remoteIP, action string) error {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return errCaptchaFailed
+	}
+	challenge, nonce := token[:i], token[i+1:]
+	claims, err := verifyPurposeToken(challenge, purposeCaptcha)
+	if err != nil {
+		return errCaptchaFailed
+	}
+	// 題目只能用在申請時的 API 與 IP，避免解出一題後到處使用
+	difficulty, _ := claims["difficulty"].(float64)
+	if claims["action"] != action || claims["ip"] != remoteIP || int(difficulty) < p.difficulty {
+		return errCaptchaFailed
+	}
+	if !pkg.CheckProofOfWork(challenge, nonce, int(difficulty)) {
+		return errCaptchaFailed
+	}
+	// 每個題目只能通過一次，避免解出一題後在期限內重複使用
+	if err := consumePurposeToken(claims); err != nil {
+		return errCaptchaFailed
+	}
+	return nil
+}
+
+// CaptchaChallenge 取得 proof-of-work captcha 的題目，action 為要呼叫的 API
+func CaptchaChallenge(c *gin.Context) {
+	verifier, ok := captchaVerifier.(proofOfWorkCaptcha)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "proof-of-work captcha is not enabled",
+		})
+		return
+	}
+
+	action := c.Query("action")
+	switch action {
+	case captchaRegister, captchaLogin, captchaForgetPassword, captchaMagicLink:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "action error",
+		})
+		return
+	}
+
+	challenge, expire, err := generatePurposeToken(purposeCaptcha, proofOfWorkTimeout, jwt.MapClaims{
+		"action":     action,
+		"ip":         clientIP(c),
+		"difficulty": verifier.difficulty,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":  challenge,
+		"difficulty": verifier.difficulty,
+		"expire":     expire.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,152 @@
+package views
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 請求的時間戳記與伺服器時間可以相差多久
+	serviceSignatureSkew = 5 * time.Minute
+	// 簽章需要讀取整個 body，限制大小
+	serviceMaxBodySize = 1 << 20
+	// X-Nonce 的長度上限
+	serviceMaxNonceLength = 64
+)
+
+// privateService 可以呼叫 private API 的服務
+type privateService struct {
+	Name        string
+	Secret      []byte
+	Permissions map[string]bool
+}
+
+// 以名稱索引的服務
+var privateServices map[string]*privateService
+
+// ErrServiceUnauthorized 服務的簽章、時間戳記或 nonce 不正確，其他錯誤為伺服器錯誤
+var ErrServiceUnauthorized = errors.New("service signature is invalid")
+
+var (
+	errServiceExpired  = fmt.Errorf("%w, timestamp is expired", ErrServiceUnauthorized)
+	errServiceNonce    = fmt.Errorf("%w, X-Nonce is missing or too long", ErrServiceUnauthorized)
+	errServiceReplayed = fmt.Errorf("%w, nonce is already used", ErrServiceUnauthorized)
+)
+
+// 上次清除過期 nonce 的時間，不需要每個請求都清除
+var (
+	serviceNonceCleanupMutex sync.Mutex
+	serviceNonceCleanedAt    time.Time
+)
+
+// setupPrivateServices 從 PRIVATE_SERVICES 讀取服務名稱，以逗號分隔，
+// 每個服務的設定為 PRIVATE_SERVICE_<NAME>_SECRET 與 PRIVATE_SERVICE_<NAME>_PERMISSIONS
+func setupPrivateServices() {
+	privateServices = map[string]*privateService{}
+	for _, name := range strings.Split(os.Getenv("PRIVATE_SERVICES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "PRIVATE_SERVICE_" + strings.ToUpper(name) + "_"
+		secret := os.Getenv(prefix + "SECRET")
+		if len(secret) < 32 {
+			log.Fatal("Service Error: " + prefix + "SECRET must be at least 32 characters")
+		}
+		service := &privateService{
+			Name:        name,
+			Secret:      []byte(secret),
+			Permissions: map[string]bool{},
+		}
+		for _, permission := range strings.Split(os.Getenv(prefix+"PERMISSIONS"), ",") {
+			if permission = strings.TrimSpace(permission); permission != "" {
+				service.Permissions[permission] = true
+			}
+		}
+		privateServices[name] = service
+	}
+}
+
+// AuthenticateService 驗證 X-Service-ID、X-Timestamp、X-Nonce 與 X-Signature，回傳呼叫的服務名稱，
+// 驗證失敗時回傳 ErrServiceUnauthorized
+func AuthenticateService(c *gin.Context) (string, error) {
+	service, ok := privateServices[c.GetHeader("X-Service-ID")]
+	if !ok {
+		return "", ErrServiceUnauthorized
+	}
+
+	timestamp := c.GetHeader("X-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrServiceUnauthorized
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > serviceSignatureSkew || skew < -serviceSignatureSkew {
+		return "", errServiceExpired
+	}
+
+	// 呼叫的服務每次請求產生不同的 nonce，同一秒內相同的請求也可以區分
+	nonce := c.GetHeader("X-Nonce")
+	if nonce == "" || len(nonce) > serviceMaxNonceLength {
+		return "", errServiceNonce
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, serviceMaxBodySize))
+		if err != nil {
+			return "", fmt.Errorf("%w, %v", ErrServiceUnauthorized, err)
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	if !pkg.VerifyRequestSignature(service.Secret, c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body, c.GetHeader("X-Signature")) {
+		return "", ErrServiceUnauthorized
+	}
+
+	// nonce 在時間戳記的有效範圍內只能使用一次，紀錄存在資料庫讓多個 instance 共用
+	used, err := models.UseServiceNonce(&models.ServiceNonce{
+		Service:   service.Name,
+		Nonce:     nonce,
+		ExpiresAt: time.Unix(unix, 0).Add(serviceSignatureSkew),
+	})
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", errServiceReplayed
+	}
+	cleanupServiceNonces()
+	return service.Name, nil
+}
+
+// cleanupServiceNonces 每隔一段時間清除過期的 nonce，失敗時只記錄在 log
+func cleanupServiceNonces() {
+	serviceNonceCleanupMutex.Lock()
+	defer serviceNonceCleanupMutex.Unlock()
+	if time.Since(serviceNonceCleanedAt) < serviceSignatureSkew {
+		return
+	}
+	serviceNonceCleanedAt = time.Now()
+	if err := models.CleanupServiceNonces(); err != nil {
+		log.Println("Service Error:", err)
+	}
+}
+
+// ServiceAllowed 檢查服務是否有呼叫 private API 的權限
+func ServiceAllowed(name, permission string) bool {
+	service, ok := privateServices[name]
+	return ok && service.Permissions[permission]
+}
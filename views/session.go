@@ -0,0 +1,300 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// 最後使用時間的精確度，避免每個請求都寫入資料庫
+const sessionTouchInterval = time.Minute
+
+// 依序比對 User-Agent，較特定的放前面，例如 Edge 與 Chrome 的 User-Agent 都有 Chrome
+var (
+	userAgentPlatforms = []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"CrOS", "ChromeOS"},
+		{"Windows", "Windows"},
+		{"Macintosh", "macOS"},
+		{"Linux", "Linux"},
+	}
+	userAgentBrowsers = []struct{ token, name string }{
+		{"Edg", "Edge"},
+		{"OPR", "Opera"},
+		{"Firefox", "Firefox"},
+		{"FxiOS", "Firefox"},
+		{"CriOS", "Chrome"},
+		{"Chrome", "Chrome"},
+		{"Safari", "Safari"},
+	}
+)
+
+// deviceName 從 User-Agent 判斷瀏覽器與作業系統，例如 Chrome on Windows
+func deviceName(userAgent string) string {
+	var platform, browser string
+	for _, p := range userAgentPlatforms {
+		if strings.Contains(userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	switch {
+	case platform != "" && browser != "":
+		return browser + " on " + platform
+	case platform != "":
+		return platform
+	case browser != "":
+		return browser
+	default:
+		return truncate(userAgent, 50)
+	}
+}
+
+// startSession 登入成功時建立 session，回傳的 SID 同時作為 refresh token 的 family
+// elevated 為 true 時視為最近驗證過身分
+func startSession(c *gin.Context, userID uint, elevated bool) (string, error) {
+	sid, err := pkg.RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	userAgent := c.GetHeader("User-Agent")
+	session := models.Session{
+		UserID:     userID,
+		SID:        sid,
+		Device:     deviceName(userAgent),
+		IP:         clientIP(c),
+		UserAgent:  userAgent,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(refreshTokenLifetime),
+	}
+	if elevated {
+		elevatedUntil := now.Add(sudoTimeout)
+		session.ElevatedUntil = &elevatedUntil
+	}
+	err = models.CreateSession(&session)
+	return sid, err
+}
+
+// resumeSession 以 refresh token 換發 access token 時延長 session，
+// 在 session 功能之前簽發的 refresh token 沒有 session，此時補建
+func resumeSession(c *gin.Context, userID uint, sid string) error {
+	now := time.Now()
+	userAgent := c.GetHeader("User-Agent")
+	session, err := models.SessionBySID(sid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.CreateSession(&models.Session{
+			UserID:     userID,
+			SID:        sid,
+			Device:     deviceName(userAgent),
+			IP:         clientIP(c),
+			UserAgent:  userAgent,
+			LastUsedAt: now,
+			ExpiresAt:  now.Add(refreshTokenLifetime),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	session.IP = clientIP(c)
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(refreshTokenLifetime)
+	return models.UpdateSession(&session)
+}
+
+// CheckSession 確認 access token 所屬的 session 尚未被撤銷，並更新最後使用的時間，
+// 沒有 sid 的 token 不屬於任何 session
+func CheckSession(claims jwt.MapClaims) (bool, error) {
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		return true, nil
+	}
+	session, err := models.SessionBySID(sid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if now := time.Now(); now.Sub(session.LastUsedAt) > sessionTouchInterval {
+		if err := models.TouchSession(sid, now); err != nil {
+			log.Println("Session Error:", err)
+		}
+	}
+	return true, nil
+}
+
+// revokeSessions 撤銷 session 與對應的 refresh token，access token 由 CheckSession 擋下
+func revokeSessions(userID uint, sessions []models.Session) error {
+	for _, session := range sessions {
+		if err := models.RevokeRefreshTokenFamily(session.SID); err != nil {
+			return err
+		}
+	}
+	return models.DeleteSessions(userID, sessions)
+}
+
+// revokeAllSessions 撤銷使用者所有的 session，用於密碼變更後要求所有裝置重新登入
+func revokeAllSessions(userID uint) error {
+	sessions, err := models.GetSessionsByUserID(userID)
+	if err != nil {
+		return err
+	}
+	return revokeSessions(userID, sessions)
+}
+
+// sessionOwner 要查看 session 或登入紀錄的使用者，管理員可以用 user_id 指定其他使用者
+func sessionOwner(c *gin.Context) (uint, bool) {
+	userID := c.MustGet("userID").(uint)
+	query := c.Query("user_id")
+	if query == "" {
+		return userID, true
+	}
+	id, err := strconv.Atoi(query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "user id error",
+		})
+		return 0, false
+	}
+	if uint(id) != userID && !c.MustGet("admin").(bool) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// GetSessions 列出登入中的裝置
+func GetSessions(c *gin.Context) {
+	userID, ok := sessionOwner(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := models.GetSessionsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	currentSID, _ := ExtractClaims(c)["sid"].(string)
+	result := []gin.H{}
+	for _, session := range sessions {
+		result = append(result, gin.H{
+			"session_id":   session.ID,
+			"device":       session.Device,
+			"ip":           session.IP,
+			"user_agent":   session.UserAgent,
+			"issued_at":    session.CreatedAt.Unix(),
+			"last_used_at": session.LastUsedAt.Unix(),
+			"expires_at":   session.ExpiresAt.Unix(),
+			"current":      session.SID == currentSID,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": result,
+	})
+}
+
+// DeleteSession 撤銷一個登入中的裝置
+func DeleteSession(c *gin.Context) {
+	userID, ok := sessionOwner(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "session id error",
+		})
+		return
+	}
+
+	sessions, err := models.GetSessionsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	var revoke []models.Session
+	for _, session := range sessions {
+		if session.ID == uint(id) {
+			revoke = append(revoke, session)
+		}
+	}
+	if len(revoke) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "session not found",
+		})
+		return
+	}
+
+	if err := revokeSessions(userID, revoke); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "revoke session success",
+	})
+}
+
+// DeleteSessions 撤銷目前裝置以外的所有 session，管理員指定其他使用者時全部撤銷
+func DeleteSessions(c *gin.Context) {
+	userID, ok := sessionOwner(c)
+	if !ok {
+		return
+	}
+
+	sessions, err := models.GetSessionsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	currentSID, _ := ExtractClaims(c)["sid"].(string)
+	var revoke []models.Session
+	for _, session := range sessions {
+		if session.SID != currentSID {
+			revoke = append(revoke, session)
+		}
+	}
+
+	if err := revokeSessions(userID, revoke); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "revoke sessions success",
+		"revoked": len(revoke),
+	})
+}
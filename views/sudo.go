@@ -0,0 +1,184 @@
+package views
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 再次驗證身分後可以進行敏感操作的時間
+const sudoTimeout = 10 * time.Minute
+
+// 預設需要最近驗證過身分的 API
+var defaultSudoRoutes = []string{
+	"PATCH /api/v1/user/password",
+	"PATCH /api/v1/user/email",
+	"PATCH /api/v1/user/permission",
+	"POST /api/v1/user/unlock",
+	"POST /api/v1/user/totp",
+	"DELETE /api/v1/user/totp",
+	"POST /api/v1/user/totp/recovery_codes",
+	"POST /api/v1/user/tokens",
+	"POST /api/v1/user/passkeys/options",
+	"DELETE /api/v1/user/passkeys/:id",
+	"DELETE /api/v1/user/identities/:id",
+	"POST /api/v1/user/impersonate",
+	"POST /api/v1/oauth/clients",
+	"DELETE /api/v1/oauth/clients/:client_id",
+}
+
+var sudoRoutes map[string]bool
+
+// setupSudoRoutes 從 SUDO_ROUTES 讀取需要最近驗證過身分的 API，以逗號分隔，例如 PATCH /api/v1/user/permission
+func setupSudoRoutes() {
+	routes := defaultSudoRoutes
+	if env := os.Getenv("SUDO_ROUTES"); env != "" {
+		routes = strings.Split(env, ",")
+	}
+	sudoRoutes = map[string]bool{}
+	for _, route := range routes {
+		if route = strings.Join(strings.Fields(route), " "); route != "" {
+			sudoRoutes[route] = true
+		}
+	}
+}
+
+// SudoRequired 檢查 API 是否需要最近驗證過身分
+func SudoRequired(method, path string) bool {
+	return sudoRoutes[method+" "+path]
+}
+
+// IsElevated 檢查 access token 所屬的 session 是否在最近驗證過身分的期限內，
+// 不屬於 session 的 token 例如 personal access token 與模擬使用者的 token 不能進行敏感操作
+func IsElevated(c *gin.Context) (bool, error) {
+	sid, ok := ExtractClaims(c)["sid"].(string)
+	if !ok {
+		return false, nil
+	}
+	session, err := models.SessionBySID(sid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return session.ElevatedUntil != nil && session.ElevatedUntil.After(time.Now()), nil
+}
+
+// AbortSudoRequired 回傳需要再次驗證身分
+func AbortSudoRequired(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"code":          http.StatusForbidden,
+		"message":       "please confirm your password to continue",
+		"sudo_required": true,
+	})
+}
+
+// confirmPassword 在 handler 中再次確認密碼，以與登入相同的驗證後端驗證，
+// 最近驗證過身分時不需要密碼，讓沒有本地密碼的 LDAP 或外部登入使用者也可以完成操作
+func confirmPassword(c *gin.Context, user *models.User, password string) (bool, error) {
+	elevated, err := IsElevated(c)
+	if err != nil || elevated {
+		return elevated, err
+	}
+	if password == "" {
+		return false, nil
+	}
+	authenticated, err := authenticate(user.UserName, password)
+	return err == nil && authenticated.ID == user.ID, nil
+}
+
+// Sudo 以密碼或兩步驟驗證碼再次驗證身分，之後一段時間內可以進行敏感操作
+func Sudo(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	sid, ok := ExtractClaims(c)["sid"].(string)
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "sudo mode is not available for this token",
+		})
+		return
+	}
+
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Password == "" && data.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	// 與登入共用失敗次數，避免以 sudo 暴力嘗試密碼
+	ip := clientIP(c)
+	if err := loginRetryAfter(user.UserName, ip); err != nil {
+		var throttled *tooManyAttemptsError
+		if errors.As(err, &throttled) {
+			abortTooManyAttempts(c, throttled)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	var verified bool
+	if data.Password != "" {
+		authenticated, err := authenticate(user.UserName, data.Password)
+		verified = err == nil && authenticated.ID == user.ID
+	} else if user.TOTPEnabled {
+		verified, err = checkTOTP(&user, data.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+	}
+	if !verified {
+		recordLoginFailure(user.UserName, ip)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "password or verify code error",
+		})
+		return
+	}
+	resetLoginFailures(user.UserName)
+
+	expire := time.Now().Add(sudoTimeout)
+	if err := models.ElevateSession(sid, expire); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "sudo mode enabled",
+		"expire":  expire.Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,293 @@
+package views
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// 超過這段時間沒有再失敗，失敗次數重新計算
+	loginFailureWindow = time.Hour
+	// 失敗太多次時鎖定的時間，也是退避時間的上限
+	loginLockoutDuration = 15 * time.Minute
+)
+
+// loginThrottlePolicy 失敗 captchaAfter 次後登入需要 captcha，失敗 backoffAfter 次後開始以指數退避，
+// 失敗 lockAfter 次後暫時鎖定
+type loginThrottlePolicy struct {
+	prefix       string
+	captchaAfter int
+	backoffAfter int
+	lockAfter    int
+}
+
+var (
+	accountThrottle = loginThrottlePolicy{prefix: "user:", captchaAfter: 2, backoffAfter: 3, lockAfter: 10}
+	// 宿舍與電腦教室共用 IP，門檻比帳號寬鬆
+	ipThrottle = loginThrottlePolicy{prefix: "ip:", captchaAfter: 5, backoffAfter: 20, lockAfter: 100}
+)
+
+// target 帳號或 IP 在資料庫中的 key
+func (p loginThrottlePolicy) target(value string) string {
+	return p.prefix + truncate(value, 90)
+}
+
+// delay 失敗 failures 次之後需要等待的時間
+func (p loginThrottlePolicy) delay(failures int) time.Duration {
+	if failures >= p.lockAfter {
+		return loginLockoutDuration
+	}
+	if failures < p.backoffAfter {
+		return 0
+	}
+	delay := time.Duration(math.Pow(2, float64(failures-p.backoffAfter))) * time.Second
+	if delay > loginLockoutDuration {
+		return loginLockoutDuration
+	}
+	return delay
+}
+
+// tooManyAttemptsError 帳號或 IP 失敗太多次，需要等待 wait 之後才能再嘗試
+type tooManyAttemptsError struct {
+	wait time.Duration
+}
+
+func (e *tooManyAttemptsError) Error() string {
+	return "too many failed login attempts, try again later"
+}
+
+// 可以信任 X-Forwarded-For 的反向代理
+var trustedProxies []*net.IPNet
+
+// setupTrustedProxies 從 TRUSTED_PROXIES 讀取反向代理的 CIDR，以逗號分隔
+func setupTrustedProxies() {
+	trustedProxies = nil
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			log.Fatal("Proxy Error: " + err.Error())
+		}
+		trustedProxies = append(trustedProxies, cidr)
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, cidr := range trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 來源 IP，只有經過信任的反向代理時才採用 X-Forwarded-For
+func clientIP(c *gin.Context) string {
+	remote, _ := c.RemoteIP()
+	if remote == nil {
+		return ""
+	}
+	if !isTrustedProxy(remote) {
+		return remote.String()
+	}
+	// 由右往左找出第一個不是反向代理的位址，左邊的位址可能是偽造的
+	hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return remote.String()
+}
+
+// loginRetryAfter 帳號或 IP 仍在鎖定期間時回傳 tooManyAttemptsError
+func loginRetryAfter(username, ip string) error {
+	var wait time.Duration
+	for _, target := range []string{accountThrottle.target(username), ipThrottle.target(ip)} {
+		throttle, err := models.LoginThrottleByTarget(target)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if remaining := time.Until(throttle.LockedUntil); remaining > wait {
+			wait = remaining
+		}
+	}
+	if wait > 0 {
+		return &tooManyAttemptsError{wait: wait}
+	}
+	return nil
+}
+
+// loginFailures 帳號或 IP 在 loginFailureWindow 內失敗的次數
+func loginFailures(target string) (int, error) {
+	throttle, err := models.LoginThrottleByTarget(target)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if throttle.LastFailureAt.Before(time.Now().Add(-loginFailureWindow)) {
+		return 0, nil
+	}
+	return throttle.Failures, nil
+}
+
+// recordLoginFailure 記錄帳號與 IP 的失敗次數，並依次數設定鎖定期限
+func recordLoginFailure(username, ip string) {
+	since := time.Now().Add(-loginFailureWindow)
+	targets := map[string]loginThrottlePolicy{
+		accountThrottle.target(username): accountThrottle,
+		ipThrottle.target(ip):            ipThrottle,
+	}
+	for target, policy := range targets {
+		throttle, err := models.RecordLoginFailure(target, since)
+		if err == nil {
+			if delay := policy.delay(throttle.Failures); delay > 0 {
+				err = models.LockLoginThrottle(target, time.Now().Add(delay))
+			}
+		}
+		if err != nil {
+			log.Println("Throttle Error:", err)
+		}
+	}
+}
+
+// resetLoginFailures 登入成功後清除帳號的失敗次數，IP 的失敗次數不清除，避免以自己的帳號重設
+func resetLoginFailures(username string) {
+	if _, err := models.ResetLoginThrottle(accountThrottle.target(username), time.Now().Add(-loginFailureWindow)); err != nil {
+		log.Println("Throttle Error:", err)
+	}
+}
+
+// abortTooManyAttempts 回傳 429 與 Retry-After
+func abortTooManyAttempts(c *gin.Context, err *tooManyAttemptsError) {
+	retryAfter := int64(math.Ceil(err.wait.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"code":        http.StatusTooManyRequests,
+		"message":     err.Error(),
+		"retry_after": retryAfter,
+	})
+}
+
+// GetLoginLockouts 管理員列出目前被鎖定的帳號與 IP
+func GetLoginLockouts(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+
+	throttles, err := models.GetLockedLoginThrottles()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	lockouts := []gin.H{}
+	for _, throttle := range throttles {
+		lockout := gin.H{
+			"failures":     throttle.Failures,
+			"locked_until": throttle.LockedUntil.Unix(),
+		}
+		if strings.HasPrefix(throttle.Target, accountThrottle.prefix) {
+			lockout["username"] = strings.TrimPrefix(throttle.Target, accountThrottle.prefix)
+		} else {
+			lockout["ip"] = strings.TrimPrefix(throttle.Target, ipThrottle.prefix)
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"lockouts": lockouts,
+	})
+}
+
+// UnlockLogin 管理員解除帳號或 IP 的鎖定
+func UnlockLogin(c *gin.Context) {
+	admin := c.MustGet("admin").(bool)
+	if !admin {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "Permission denied",
+		})
+		return
+	}
+
+	var data struct {
+		UserID *uint  `json:"user_id"`
+		IP     string `json:"ip"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	var target string
+	switch {
+	case data.UserID != nil:
+		user, err := models.UserDetailByID(*data.UserID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{
+				"message": "no such user",
+			})
+			return
+		}
+		target = accountThrottle.target(user.UserName)
+	case net.ParseIP(data.IP) != nil:
+		target = ipThrottle.target(net.ParseIP(data.IP).String())
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	deleted, err := models.ResetLoginThrottle(target, time.Now().Add(-loginFailureWindow))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "unlock success",
+		"unlocked": deleted,
+	})
+}
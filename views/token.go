@@ -0,0 +1,686 @@
+package views
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/vincentinttsh/zero"
+	"gorm.io/gorm"
+)
+
+const (
+	// access token 有效期限
+	tokenTimeout = 4 * time.Hour
+	// 舊的 GET /token 可以在登入後多久內換發 access token
+	tokenMaxRefresh = time.Hour
+	// refresh token 有效期限，讓學生一整個學期都不用重新登入
+	refreshTokenLifetime = 180 * 24 * time.Hour
+	// 輸入兩步驟驗證碼的時間
+	mfaTokenTimeout = 5 * time.Minute
+)
+
+// purpose token 的用途
+const (
+	purposeMFA              = "mfa"
+	purposeWebAuthnRegister = "webauthn_register"
+	purposeWebAuthnLogin    = "webauthn_login"
+	purposeOIDC             = "oidc"
+	purposeOAuthAccess      = "oauth_access"
+	purposeCaptcha          = "captcha"
+	purposeMagicLink        = "magic_link"
+)
+
+// 多久從資料庫重新載入一次 key ring，讓金鑰輪替不需要重啟服務
+const keyRingReloadInterval = time.Minute
+
+var (
+	keyRing       *pkg.KeyRing
+	keyRingMutex  sync.RWMutex
+	keyRingReload sync.Once
+)
+
+// envSigningKey 依 JWT_ALGORITHM 載入環境變數設定的金鑰，預設沿用 SECRET_KEY 的 HS512
+func envSigningKey() (*pkg.SigningKey, error) {
+	keyID := os.Getenv("JWT_KEY_ID")
+	switch algorithm := os.Getenv("JWT_ALGORITHM"); algorithm {
+	case "", jwt.SigningMethodHS512.Alg():
+		if keyID == "" {
+			keyID = "default"
+		}
+		return pkg.NewHMACKey(keyID, []byte(os.Getenv("SECRET_KEY"))), nil
+	default:
+		return pkg.LoadSigningKey(keyID, algorithm, os.Getenv("JWT_PRIVATE_KEY_FILE"))
+	}
+}
+
+// loadKeyRing 組合資料庫中的金鑰與環境變數設定的金鑰，
+// 資料庫沒有簽署金鑰時使用環境變數的金鑰簽署
+func loadKeyRing() error {
+	envKey, err := envSigningKey()
+	if err != nil {
+		return err
+	}
+
+	stored, err := models.GetAllSigningKeys()
+	if err != nil {
+		return err
+	}
+
+	var signing *pkg.SigningKey
+	var verify []*pkg.SigningKey
+	envKeyRetired := false
+	for _, s := range stored {
+		if s.Status == models.SigningKeyStatusRetired {
+			envKeyRetired = envKeyRetired || s.KID == envKey.ID
+			continue
+		}
+		data, err := pkg.DecryptPrivateKey(s.PrivateKey)
+		if err != nil {
+			return err
+		}
+		key, err := pkg.ParseSigningKey(s.KID, s.Algorithm, data)
+		if err != nil {
+			return err
+		}
+		if s.Status == models.SigningKeyStatusSigning {
+			signing = key
+		} else {
+			verify = append(verify, key)
+		}
+	}
+
+	if !envKeyRetired {
+		if signing == nil {
+			signing = envKey
+		} else {
+			verify = append(verify, envKey)
+		}
+	}
+	if signing == nil {
+		return errors.New("no signing key available")
+	}
+
+	keyRingMutex.Lock()
+	keyRing = pkg.NewKeyRing(signing, verify...)
+	keyRingMutex.Unlock()
+	return nil
+}
+
+// reloadKeyRing 在背景定期重新載入 key ring，載入失敗則沿用舊的
+func reloadKeyRing() {
+	for range time.Tick(keyRingReloadInterval) {
+		if err := loadKeyRing(); err != nil {
+			log.Println("JWT Error:" + err.Error())
+		}
+	}
+}
+
+// currentKeyRing 取得目前的 key ring
+func currentKeyRing() *pkg.KeyRing {
+	keyRingMutex.RLock()
+	defer keyRingMutex.RUnlock()
+	return keyRing
+}
+
+// userClaims access token 與 ID token 共用的使用者資訊
+func userClaims(user *models.User) jwt.MapClaims {
+	return jwt.MapClaims{
+		"username": user.UserName,
+		"admin":    user.Admin,
+		"teacher":  user.Teacher,
+	}
+}
+
+// GenerateToken 簽發屬於 session sid 的 access token
+func GenerateToken(user *models.User, sid string) (string, time.Time, error) {
+	jti, err := pkg.RandomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expire := now.Add(tokenTimeout)
+	claims := userClaims(user)
+	claims["jti"] = jti
+	claims["id"] = strconv.FormatUint(uint64(user.ID), 10)
+	claims["sid"] = sid
+	claims["ver"] = user.TokenVersion
+	claims["exp"] = expire.Unix()
+	claims["iat"] = now.Unix()
+	claims["orig_iat"] = now.Unix()
+	token, err := currentKeyRing().Signing().Sign(claims)
+	return token, expire, err
+}
+
+// VerifyToken 驗證 access token，回傳 claims
+func VerifyToken(token string) (jwt.MapClaims, error) {
+	claims, err := pkg.ParseToken(token, currentKeyRing().Lookup)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, errors.New("missing exp field")
+	}
+	// 特定用途的 token 不能當作 access token 使用
+	if _, ok := claims["purpose"]; ok {
+		return nil, errors.New("token is invalid")
+	}
+	// 簽發給其他 audience 的 token，例如 ID token
+	if _, ok := claims["aud"]; ok {
+		return nil, errors.New("token is invalid")
+	}
+	return claims, nil
+}
+
+// ErrTokenOutdated token 簽發後使用者的權限已經改變、密碼已經重設或帳號已經停用
+var ErrTokenOutdated = errors.New("token is outdated, please login again")
+
+// errAccountSuspended 帳號已被停用
+var errAccountSuspended = errors.New("account is suspended")
+
+// claimVersion 取得 claims 中的 token version，沒有 version 的舊 token 視為 0
+func claimVersion(claims jwt.MapClaims) uint {
+	switch version := claims["ver"].(type) {
+	case float64:
+		return uint(version)
+	case uint:
+		return version
+	}
+	return 0
+}
+
+// TokenUser 以資料庫中目前的資料確認 token 仍然有效，回傳 token 所屬的使用者，
+// 權限變更、重設密碼與停用帳號時 token version 會增加，之前簽發的 token 立即失效
+func TokenUser(claims jwt.MapClaims) (*models.User, error) {
+	userID, err := claimUserID(claims)
+	if err != nil {
+		return nil, ErrTokenOutdated
+	}
+	user, err := models.UserDetailByID(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTokenOutdated
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Suspended || user.TokenVersion != claimVersion(claims) {
+		return nil, ErrTokenOutdated
+	}
+	// 模擬使用者的管理員失去權限時，模擬也一併結束
+	if id, ok := claims["impersonator"].(string); ok {
+		impersonatorID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, ErrTokenOutdated
+		}
+		impersonator, err := models.UserDetailByID(uint(impersonatorID))
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTokenOutdated
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !impersonator.Admin || impersonator.Suspended {
+			return nil, ErrTokenOutdated
+		}
+	}
+	return &user, nil
+}
+
+// generatePurposeToken 簽發只能用在特定流程的短效 token，例如登入的第二步驟
+func generatePurposeToken(purpose string, timeout time.Duration, claims jwt.MapClaims) (string, time.Time, error) {
+	jti, err := pkg.RandomToken(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expire := time.Now().Add(timeout)
+	claims["jti"] = jti
+	claims["purpose"] = purpose
+	claims["exp"] = expire.Unix()
+	token, err := currentKeyRing().Signing().Sign(claims)
+	return token, expire, err
+}
+
+// verifyPurposeToken 驗證特定用途的 token，回傳 claims
+func verifyPurposeToken(token, purpose string) (jwt.MapClaims, error) {
+	claims, err := pkg.ParseToken(token, currentKeyRing().Lookup)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["exp"].(float64); !ok || claims["purpose"] != purpose {
+		return nil, errors.New("token is invalid")
+	}
+	return claims, nil
+}
+
+// consumePurposeToken 將特定用途的 token 標記為已使用，同一個 token 只能成功使用一次
+func consumePurposeToken(claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+	id, _ := claimUserID(claims)
+	return models.RevokeToken(&models.RevokedToken{
+		JTI:       jti,
+		UserID:    id,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	})
+}
+
+// claimUserID 取得 claims 中的 user id
+func claimUserID(claims jwt.MapClaims) (uint, error) {
+	id, _ := claims["id"].(string)
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, err
+	}
+	return uint(userID), nil
+}
+
+// ExtractClaims 取得驗證過的 JWT claims
+func ExtractClaims(c *gin.Context) jwt.MapClaims {
+	claims, exists := c.Get("JWT_PAYLOAD")
+	if !exists {
+		return jwt.MapClaims{}
+	}
+	return claims.(jwt.MapClaims)
+}
+
+// newRefreshToken 產生 refresh token，family 為空時開始新的 family
+func newRefreshToken(user *models.User, family string) (token string, err error) {
+	if token, err = pkg.RandomToken(32); err != nil {
+		return
+	}
+	if family == "" {
+		if family, err = pkg.RandomToken(16); err != nil {
+			return
+		}
+	}
+	err = models.CreateRefreshToken(&models.RefreshToken{
+		UserID:       user.ID,
+		Family:       family,
+		TokenHash:    pkg.HashToken(token),
+		ExpiresAt:    time.Now().Add(refreshTokenLifetime),
+		TokenVersion: user.TokenVersion,
+	})
+	return
+}
+
+// abortSuspended 帳號已被停用時回傳錯誤
+func abortSuspended(c *gin.Context, user *models.User) bool {
+	if !user.Suspended {
+		return false
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"code":    http.StatusForbidden,
+		"message": errAccountSuspended.Error(),
+	})
+	return true
+}
+
+// loginSuccess 完成登入，建立 session 並回傳 access token 與 refresh token，
+// 只有實際簽發 token 時才記錄為成功登入
+func loginSuccess(c *gin.Context, user *models.User, identifier, method string) {
+	if abortSuspended(c, user) {
+		return
+	}
+
+	sid, err := startSession(c, user.ID, elevatingLoginMethods[method])
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	token, expire, err := GenerateToken(user, sid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	refreshToken, err := newRefreshToken(user, sid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := setSessionCookies(c, token, expire, refreshToken, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	recordLoginAttempt(c, user.ID, identifier, method, "")
+	c.JSON(http.StatusOK, gin.H{
+		"code":          http.StatusOK,
+		"token":         token,
+		"expire":        expire.Format(time.RFC3339),
+		"refresh_token": refreshToken,
+	})
+}
+
+// LoginHandler 登入，有啟用兩步驟驗證時先回傳 mfa token，驗證碼通過後才簽發 access token
+func LoginHandler(c *gin.Context) {
+	data, err := Login(c)
+	var throttled *tooManyAttemptsError
+	if errors.As(err, &throttled) {
+		abortTooManyAttempts(c, throttled)
+		return
+	}
+	if errors.Is(err, errCaptchaFailed) {
+		respondCaptchaError(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": err.Error(),
+		})
+		return
+	}
+	user := data.(*models.User)
+	loginWithMFA(c, user, c.GetString(loginIdentifierKey), passwordLoginMethod(user))
+}
+
+// loginWithMFA 密碼以外的第一步驗證通過後，依使用者是否啟用兩步驟驗證簽發 mfa token 或 access token
+func loginWithMFA(c *gin.Context, user *models.User, identifier, method string) {
+	if abortSuspended(c, user) {
+		return
+	}
+	if user.TOTPEnabled && !isTrustedDevice(c, user.ID) {
+		mfaToken, expire, err := generatePurposeToken(purposeMFA, mfaTokenTimeout, jwt.MapClaims{
+			"id": strconv.FormatUint(uint64(user.ID), 10),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+		// 第一步驗證另外記錄，兩步驟驗證通過後才記錄為成功
+		recordLoginAttempt(c, user.ID, identifier, method, loginPendingMFA)
+		c.JSON(http.StatusOK, gin.H{
+			"code":         http.StatusOK,
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expire":       expire.Format(time.RFC3339),
+		})
+		return
+	}
+
+	loginSuccess(c, user, identifier, method)
+}
+
+// RefreshHandler 在登入後一小時內以目前的 access token 換發新的 access token
+func RefreshHandler(c *gin.Context) {
+	claims := ExtractClaims(c)
+	origIat, _ := claims["orig_iat"].(float64)
+	if int64(origIat) < time.Now().Add(-tokenMaxRefresh).Unix() {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "token is expired",
+		})
+		return
+	}
+
+	// 以資料庫中目前的資料簽發，停用的帳號與權限已變更的 token 不能換發
+	user, err := TokenUser(claims)
+	if errors.Is(err, ErrTokenOutdated) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	// 新的 token 使用新的 jti，登出或撤銷時不會影響到另一個 token
+	jti, err := pkg.RandomToken(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	// 保留原本的 orig_iat，換發的期限從登入時開始計算，不會因為持續換發而無限延長
+	now := time.Now()
+	expire := now.Add(tokenTimeout)
+	newClaims := userClaims(user)
+	newClaims["jti"] = jti
+	newClaims["id"] = claims["id"]
+	newClaims["sid"] = claims["sid"]
+	newClaims["ver"] = user.TokenVersion
+	newClaims["exp"] = expire.Unix()
+	newClaims["iat"] = now.Unix()
+	newClaims["orig_iat"] = int64(origIat)
+
+	token, err := currentKeyRing().Signing().Sign(newClaims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := setSessionCookies(c, token, expire, "", false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":   http.StatusOK,
+		"token":  token,
+		"expire": expire.Format(time.RFC3339),
+	})
+}
+
+// RefreshToken 用 refresh token 換發 access token，並輪替 refresh token
+func RefreshToken(c *gin.Context) {
+	var data struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// cookie 模式下可以不帶 body
+	if err := c.ShouldBindJSON(&data); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.RefreshToken == "" {
+		data.RefreshToken = cookieRefreshToken(c)
+		// 瀏覽器會自動帶上 cookie，需要確認請求來自前端
+		if data.RefreshToken != "" && !CheckCSRF(c) {
+			AbortCSRF(c)
+			return
+		}
+	}
+
+	if zero.IsZero(data) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	stored, err := models.RefreshTokenByHash(pkg.HashToken(data.RefreshToken))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"message": "refresh token is invalid",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	// family 簽發之後權限變更、重設密碼或停用帳號時不能再換發
+	if stored.Revoked || stored.ExpiresAt.Before(time.Now()) || stored.User.Suspended ||
+		stored.TokenVersion != stored.User.TokenVersion {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "refresh token is invalid",
+		})
+		return
+	}
+
+	rotated, err := models.RotateRefreshToken(&stored)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	// 已經輪替過的 token 又被拿來用，代表 token 可能外流，整個 family 與對應的 session 一起撤銷，
+	// 以這個 session 簽發的 access token 也由 CheckSession 擋下
+	if !rotated {
+		err := models.RevokeRefreshTokenFamily(stored.Family)
+		if err == nil {
+			var session models.Session
+			session, err = models.SessionBySID(stored.Family)
+			if err == nil {
+				err = revokeSessions(stored.UserID, []models.Session{session})
+			}
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "refresh token reuse detected",
+		})
+		return
+	}
+
+	refreshToken, err := newRefreshToken(&stored.User, stored.Family)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := resumeSession(c, stored.UserID, stored.Family); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	token, expire, err := GenerateToken(&stored.User, stored.Family)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := setSessionCookies(c, token, expire, refreshToken, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"code":          http.StatusOK,
+		"token":         token,
+		"expire":        expire.Format(time.RFC3339),
+		"refresh_token": refreshToken,
+	})
+}
+
+// Logout 登出，撤銷目前使用的 token 與 session，有帶 refresh token 時一併撤銷
+func Logout(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	claims := ExtractClaims(c)
+	jti, _ := claims["jti"].(string)
+	exp, _ := claims["exp"].(float64)
+
+	token := models.RevokedToken{
+		JTI:       jti,
+		UserID:    userID,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}
+
+	if err := models.RevokeToken(&token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if sid, ok := claims["sid"].(string); ok {
+		session, err := models.SessionBySID(sid)
+		if err == nil {
+			err = revokeSessions(userID, []models.Session{session})
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+	}
+
+	var data struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	c.ShouldBindJSON(&data)
+	if data.RefreshToken == "" {
+		// authRequired 已經檢查過 CSRF
+		data.RefreshToken = cookieRefreshToken(c)
+	}
+	if data.RefreshToken != "" {
+		stored, err := models.RefreshTokenByHash(pkg.HashToken(data.RefreshToken))
+		if err == nil && stored.UserID == userID {
+			if err := models.RevokeRefreshTokenFamily(stored.Family); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"message": "Server error",
+				})
+				return
+			}
+		}
+	}
+
+	clearSessionCookies(c)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "logout success",
+	})
+}
+
+// JWKS 公開驗證 token 用的公鑰，讓其他服務不需要持有簽章金鑰
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"keys": currentKeyRing().JWKS(),
+	})
+}
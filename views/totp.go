@@ -0,0 +1,493 @@
+package views
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/vincentinttsh/zero"
+)
+
+const (
+	recoveryCodeCount     = 10
+	trustedDeviceLifetime = 30 * 24 * time.Hour
+	trustedDeviceCookie   = "trusted_device"
+)
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "NCNUOJ"
+}
+
+// checkTOTP 驗證使用者的驗證碼，通過後記錄使用過的區間，同一組驗證碼不能重複使用
+func checkTOTP(user *models.User, code string) (bool, error) {
+	secret, err := pkg.DecryptTOTPSecret(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := pkg.ValidateTOTP(secret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	user.TOTPLastStep = step
+	return true, models.UpdateUser(user)
+}
+
+// normalizeRecoveryCode 備用碼不分大小寫，忽略 - 與空白
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// newRecoveryCodes 產生一組新的備用碼，取代舊的備用碼
+func newRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := pkg.RandomCode(10)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = pkg.HashToken(normalizeRecoveryCode(code))
+	}
+	if err := models.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// trustDevice 記住這個瀏覽器，期限內登入不需要輸入驗證碼
+func trustDevice(c *gin.Context, userID uint) error {
+	token, err := pkg.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	err = models.CreateTrustedDevice(&models.TrustedDevice{
+		UserID:    userID,
+		TokenHash: pkg.HashToken(token),
+		UserAgent: c.Request.UserAgent(),
+		ExpiresAt: time.Now().Add(trustedDeviceLifetime),
+	})
+	if err != nil {
+		return err
+	}
+	// 啟用 cookie 模式時與 session cookie 相同的 SameSite 設定
+	if cookieSession {
+		setCookie(c, trustedDeviceCookie, token, int(trustedDeviceLifetime.Seconds()), "/api/v1/token", true)
+		return nil
+	}
+	secure := gin.Mode() == gin.ReleaseMode
+	if secure {
+		// 前端與 API 不同網域，cookie 需要 SameSite=None 才會在登入時送出
+		c.SetSameSite(http.SameSiteNoneMode)
+	} else {
+		c.SetSameSite(http.SameSiteLaxMode)
+	}
+	c.SetCookie(trustedDeviceCookie, token, int(trustedDeviceLifetime.Seconds()), "/api/v1/token", "", secure, true)
+	return nil
+}
+
+// isTrustedDevice 檢查請求是否來自使用者信任的瀏覽器
+func isTrustedDevice(c *gin.Context, userID uint) bool {
+	token, err := c.Cookie(trustedDeviceCookie)
+	if err != nil || token == "" {
+		return false
+	}
+	trusted, err := models.IsTrustedDevice(userID, pkg.HashToken(token))
+	return err == nil && trusted
+}
+
+// EnrollTOTP 開始設定兩步驟驗證，回傳密鑰與 otpauth URI，需再用驗證碼確認才會啟用
+func EnrollTOTP(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := pkg.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	// 密鑰加密後才存入資料庫
+	if user.TOTPSecret, err = pkg.EncryptTOTPSecret(secret); err != nil {
+		log.Println("TOTP Error:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	user.TOTPLastStep = 0
+	if err := models.UpdateUser(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    pkg.TOTPURI(totpIssuer(), user.UserName, secret),
+	})
+}
+
+// ConfirmTOTP 用第一組驗證碼確認並啟用兩步驟驗證
+func ConfirmTOTP(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var data struct {
+		Code string `json:"code"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if zero.IsZero(data) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication is not being enrolled",
+		})
+		return
+	}
+
+	ok, err := checkTOTP(&user, data.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "verify code error",
+		})
+		return
+	}
+
+	user.TOTPEnabled = true
+	if err := models.UpdateUser(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	codes, err := newRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+// RegenerateRecoveryCodes 重新產生備用碼，舊的備用碼全部失效，最近沒有驗證過身分時需要再次輸入密碼
+func RegenerateRecoveryCodes(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var data struct {
+		Password string `json:"password"`
+	}
+
+	if err := c.ShouldBindJSON(&data); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication is not enabled",
+		})
+		return
+	}
+
+	if confirmed, err := confirmPassword(c, &user, data.Password); err != nil || !confirmed {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "password is wrong",
+		})
+		return
+	}
+
+	codes, err := newRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": codes,
+	})
+}
+
+// ForgetTrustedDevices 取消信任所有瀏覽器，之後登入都需要輸入驗證碼
+func ForgetTrustedDevices(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	if err := models.DeleteTrustedDevices(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "trusted devices removed",
+	})
+}
+
+// DisableTOTP 停用兩步驟驗證，需要驗證碼，最近沒有驗證過身分時還需要再次輸入密碼
+func DisableTOTP(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var data struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "two-factor authentication is not enabled",
+		})
+		return
+	}
+
+	if confirmed, err := confirmPassword(c, &user, data.Password); err != nil || !confirmed {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "password is wrong",
+		})
+		return
+	}
+
+	ok, err := checkTOTP(&user, data.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "verify code error",
+		})
+		return
+	}
+
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	if err := models.UpdateUser(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := models.DeleteRecoveryCodes(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if err := models.DeleteTrustedDevices(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "two-factor authentication disabled",
+	})
+}
+
+// LoginTOTP 登入的第二步驟，用 mfa token 與驗證碼或備用碼換取 access token
+func LoginTOTP(c *gin.Context) {
+	var data struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		TrustDevice  bool   `json:"trust_device"`
+	}
+
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	if data.MFAToken == "" || (data.Code == "" && data.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	claims, err := verifyPurposeToken(data.MFAToken, purposeMFA)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "mfa token is invalid",
+		})
+		return
+	}
+
+	userID, _ := claimUserID(claims)
+	user, err := models.UserDetailByID(userID)
+	if err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "mfa token is invalid",
+		})
+		return
+	}
+
+	// 驗證碼與密碼共用失敗次數，避免在 mfa token 的有效期限內暴力嘗試
+	ip := clientIP(c)
+	if err := loginRetryAfter(user.UserName, ip); err != nil {
+		var throttled *tooManyAttemptsError
+		if errors.As(err, &throttled) {
+			abortTooManyAttempts(c, throttled)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	var ok bool
+	method := loginMethodTOTP
+	if data.Code != "" {
+		ok, err = checkTOTP(&user, data.Code)
+	} else {
+		method = loginMethodRecoveryCode
+		ok, err = models.UseRecoveryCode(user.ID, pkg.HashToken(normalizeRecoveryCode(data.RecoveryCode)))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !ok {
+		recordLoginFailure(user.UserName, ip)
+		recordLoginAttempt(c, user.ID, user.UserName, method, loginFailureWrongCode)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "verify code error",
+		})
+		return
+	}
+	resetLoginFailures(user.UserName)
+
+	// mfa token 只能使用一次，重複使用時記錄為失敗
+	if err := consumePurposeToken(claims); err != nil {
+		recordLoginAttempt(c, user.ID, user.UserName, method, loginFailureInvalidToken)
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "mfa token is invalid",
+		})
+		return
+	}
+
+	if data.TrustDevice {
+		if err := trustDevice(c, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "Server error",
+			})
+			return
+		}
+	}
+
+	loginSuccess(c, &user, user.UserName, method)
+}
@@ -5,21 +5,17 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"time"
 
 	"github.com/NCNUCodeOJ/BackendUser/models"
 	"github.com/NCNUCodeOJ/BackendUser/pkg"
 	"github.com/gin-gonic/gin"
-	"github.com/meyskens/go-hcaptcha"
 	"github.com/vincentinttsh/replace"
 	"github.com/vincentinttsh/zero"
 	"gorm.io/gorm"
 )
 
-var captchaClient *hcaptcha.HCaptcha
-
 func isValidURL(toTest string) bool {
 	_, err := url.ParseRequestURI(toTest)
 	if err != nil {
@@ -45,6 +41,8 @@ func UserRegister(c *gin.Context) {
 		StudentID string `json:"student_id"`
 		UserName  string `json:"username"`
 		Avatar    string `json:"avatar"`
+		// 沒有啟用 captcha 時可以省略
+		CaptchaToken string `json:"captcha_token"`
 	}
 
 	if err := c.BindJSON(&data); err != nil {
@@ -55,7 +53,9 @@ func UserRegister(c *gin.Context) {
 	}
 
 	userAvatar := data.Avatar
+	captchaToken := data.CaptchaToken
 	data.Avatar = "default"
+	data.CaptchaToken = "default"
 
 	if zero.IsZero(data) {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -65,6 +65,7 @@ func UserRegister(c *gin.Context) {
 	}
 
 	data.Avatar = userAvatar
+	data.CaptchaToken = captchaToken
 
 	if data.Avatar != "" && !isValidURL(data.Avatar) {
 		c.JSON(http.StatusBadRequest, gin.H{
@@ -73,7 +74,6 @@ func UserRegister(c *gin.Context) {
 		return
 	}
 
-	isValidUserName := regexp.MustCompile(`^[a-zA-Z0-9]+$`).MatchString
 	if !isValidUserName(data.UserName) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "username can only contain letters and numbers",
@@ -81,6 +81,11 @@ func UserRegister(c *gin.Context) {
 		return
 	}
 
+	if err := checkCaptcha(c, captchaRegister, data.CaptchaToken); err != nil {
+		respondCaptchaError(c, err)
+		return
+	}
+
 	_, err = models.UserDetailByUserName(data.UserName)
 
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
@@ -96,6 +101,20 @@ func UserRegister(c *gin.Context) {
 		return
 	}
 
+	message, err := identifierTaken(0, data.UserName, data.Email, data.StudentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "server error",
+		})
+		return
+	}
+	if message != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": message,
+		})
+		return
+	}
+
 	if len(data.Password) < 6 {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"message": "password is too short, at least 6 characters",
@@ -142,14 +161,15 @@ func UserInfo(c *gin.Context) {
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{
-		"user_id":    strconv.FormatUint(uint64(user.ID), 10),
-		"username":   user.UserName,
-		"realname":   user.RealName,
-		"email":      user.Email,
-		"student_id": user.StudentID,
-		"admin":      user.Admin,
-		"teacher":    user.Teacher,
-		"avatar":     user.Avatar,
+		"user_id":      strconv.FormatUint(uint64(user.ID), 10),
+		"username":     user.UserName,
+		"realname":     user.RealName,
+		"email":        user.Email,
+		"student_id":   user.StudentID,
+		"admin":        user.Admin,
+		"teacher":      user.Teacher,
+		"avatar":       user.Avatar,
+		"totp_enabled": user.TOTPEnabled,
 	})
 }
 
@@ -166,30 +186,56 @@ func Pong(c *gin.Context) {
 	})
 }
 
-// Login login
+// Login login，username 也可以是 email 或學號
 func Login(c *gin.Context) (interface{}, error) {
 	var d struct {
 		Name     *string `json:"username"`
 		Password *string `json:"password"`
+		// 沒有啟用 captcha 時可以省略
+		CaptchaToken string `json:"captcha_token"`
 	}
 
 	if err := c.BindJSON(&d); err != nil {
 		return nil, errors.New("json format error")
 	}
-	if zero.IsZero(d) {
+	if d.Name == nil || d.Password == nil {
 		return nil, errors.New("data is not complete")
 	}
-
-	u, err := models.UserDetailByUserName(*d.Name)
+	name, err := loginUserName(*d.Name)
 	if err != nil {
-		return nil, errors.New("username or password is wrong")
+		log.Println("Login Error:", err)
+		return nil, errors.New("server error")
 	}
 
-	if pkg.Compare(u.Password, *d.Password) == nil {
-		return &u, nil
+	ip := clientIP(c)
+	if err := loginRetryAfter(name, ip); err != nil {
+		var throttled *tooManyAttemptsError
+		if errors.As(err, &throttled) {
+			recordLoginFailureAttempt(c, name, *d.Name, loginMethodPassword, loginFailureThrottled)
+			return nil, err
+		}
+		log.Println("Throttle Error:", err)
+		return nil, errors.New("server error")
+	}
+
+	if err := checkLoginCaptcha(c, name, ip, d.CaptchaToken); err != nil {
+		if errors.Is(err, errCaptchaFailed) {
+			recordLoginFailureAttempt(c, name, *d.Name, loginMethodPassword, loginFailureCaptcha)
+			return nil, err
+		}
+		log.Println("Captcha Error:", err)
+		return nil, errors.New("server error")
 	}
 
-	return nil, errors.New("username or password is wrong")
+	user, err := authenticate(name, *d.Password)
+	if err != nil {
+		recordLoginFailure(name, ip)
+		recordLoginFailureAttempt(c, name, *d.Name, loginMethodPassword, loginFailureWrongCredentials)
+		return nil, err
+	}
+	resetLoginFailures(name)
+	c.Set(loginIdentifierKey, *d.Name)
+	return user, nil
 }
 
 // UserChangeInfo 使用者更改自己的資訊
@@ -197,8 +243,6 @@ func UserChangeInfo(c *gin.Context) {
 	userID := c.MustGet("userID").(uint)
 	user, err := models.UserDetailByID(uint(userID))
 
-	var pwd string
-
 	if err != nil {
 		c.JSON(http.StatusForbidden, gin.H{
 			"message": "no such user",
@@ -237,34 +281,173 @@ func UserChangeInfo(c *gin.Context) {
 		log.Printf("%+v\n", user)
 	}
 
-	if data.Password != nil && len(*data.Password) < 6 {
+	// 密碼與 email 改由獨立的 API 更改，舊的用法在淘汰前仍然接受，但套用與獨立 API 相同的限制
+	if data.Password != nil {
+		c.Header("Deprecation", "true")
+		if !deprecatedChangeAllowed(c, "/api/v1/user/password") {
+			return
+		}
+		pwd, ok := hashNewPassword(c, *data.Password)
+		if !ok {
+			return
+		}
+		data.Password = &pwd
+	}
+	var email, studentID string
+	if data.Email != nil {
+		c.Header("Deprecation", "true")
+		if !deprecatedChangeAllowed(c, "/api/v1/user/email") {
+			return
+		}
+		if *data.Email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "data is not complete",
+			})
+			return
+		}
+		email = *data.Email
+	}
+	if data.StudentID != nil {
+		studentID = *data.StudentID
+	}
+	message, err := identifierTaken(user.ID, "", email, studentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "server error",
+		})
+		return
+	}
+	if message != "" {
 		c.JSON(http.StatusUnauthorized, gin.H{
-			"message": "password is too short, at least 6 characters",
+			"message": message,
 		})
 		return
 	}
 
-	if !zero.IsZero(data.Password) {
-		pwd, err = pkg.Encrypt(*data.Password)
-		if err != nil {
+	replace.Replace(&user, &data)
+	if data.Password != nil {
+		user.TokenVersion++
+	}
+
+	if needLog {
+		log.Printf("%+v\n", user)
+	}
+
+	if err := models.UpdateUser(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "update failed",
+		})
+		return
+	}
+	if data.Password != nil {
+		if err := revokeAllSessions(user.ID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"message": "system error",
+				"message": "Server error",
 			})
 			return
 		}
-		data.Password = &pwd
 	}
 
-	replace.Replace(&user, &data)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "update success",
+	})
+}
 
-	if needLog {
-		log.Printf("%+v\n", user)
+// UserChangePassword 更改密碼，需要最近驗證過身分
+func UserChangePassword(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+	var data struct {
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+	if zero.IsZero(data) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+	var ok bool
+	if user.Password, ok = hashNewPassword(c, data.Password); !ok {
+		return
+	}
+	// 更改密碼後所有裝置都需要重新登入
+	user.TokenVersion++
+	if err := models.UpdateUser(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "update failed",
+		})
+		return
+	}
+	if err := revokeAllSessions(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "update success",
+	})
+}
+
+// UserChangeEmail 更改 email，需要最近驗證過身分
+func UserChangeEmail(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+	var data struct {
+		Email string `json:"email"`
+	}
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+	if zero.IsZero(data) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	message, err := identifierTaken(user.ID, "", data.Email, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "server error",
+		})
+		return
+	}
+	if message != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": message,
+		})
+		return
 	}
 
+	user.Email = data.Email
 	if err := models.UpdateUser(&user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"message": "update failed",
 		})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -272,6 +455,51 @@ func UserChangeInfo(c *gin.Context) {
 	})
 }
 
+// hashNewPassword 檢查新密碼的長度並加密，失敗時回應錯誤
+func hashNewPassword(c *gin.Context, password string) (string, bool) {
+	if len(password) < 6 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "password is too short, at least 6 characters",
+		})
+		return "", false
+	}
+	hashed, err := pkg.Encrypt(password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "system error",
+		})
+		return "", false
+	}
+	return hashed, true
+}
+
+// deprecatedChangeAllowed 以 PATCH /api/v1/user 更改密碼或 email 時，
+// 套用對應的獨立 API 的 sudo 設定，並且禁止模擬使用者
+func deprecatedChangeAllowed(c *gin.Context, path string) bool {
+	if _, ok := Impersonator(c); ok {
+		c.JSON(http.StatusForbidden, gin.H{
+			"code":    http.StatusForbidden,
+			"message": "not allowed while impersonating",
+		})
+		return false
+	}
+	if !SudoRequired(http.MethodPatch, path) {
+		return true
+	}
+	elevated, err := IsElevated(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return false
+	}
+	if !elevated {
+		AbortSudoRequired(c)
+		return false
+	}
+	return true
+}
+
 // ChangeUserPermissions 使用者更改權限
 func ChangeUserPermissions(c *gin.Context) {
 	admin := c.MustGet("admin").(bool)
@@ -283,9 +511,10 @@ func ChangeUserPermissions(c *gin.Context) {
 	}
 
 	var data struct {
-		UserID  *uint `json:"user_id"`
-		Admin   *bool `json:"admin"`
-		Teacher *bool `json:"teacher"`
+		UserID    *uint `json:"user_id"`
+		Admin     *bool `json:"admin"`
+		Teacher   *bool `json:"teacher"`
+		Suspended *bool `json:"suspended"`
 	}
 
 	if err := c.BindJSON(&data); err != nil {
@@ -310,12 +539,20 @@ func ChangeUserPermissions(c *gin.Context) {
 		return
 	}
 
+	admin, teacher, suspended := user.Admin, user.Teacher, user.Suspended
 	if data.Admin != nil {
 		user.Admin = *data.Admin
 	}
 	if data.Teacher != nil {
 		user.Teacher = *data.Teacher
 	}
+	if data.Suspended != nil {
+		user.Suspended = *data.Suspended
+	}
+	// 權限改變時讓已簽發的 token 失效，使用者需要重新取得 token
+	if user.Admin != admin || user.Teacher != teacher || user.Suspended != suspended {
+		user.TokenVersion++
+	}
 
 	if err := models.UpdateUser(&user); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -343,25 +580,15 @@ func UserForgetPassword(c *gin.Context) {
 		return
 	}
 
-	if zero.IsZero(data) {
+	if data.Username == "" {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "data is not complete",
 		})
 		return
 	}
 
-	captchaRes, err := captchaClient.Verify(data.CaptchaToken, c.ClientIP())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Server error",
-		})
-		return
-	}
-	// fmt.Printf("%+v\n", captchaRes)
-	if !captchaRes.Success {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"message": captchaRes.ErrorCodes,
-		})
+	if err := checkCaptcha(c, captchaForgetPassword, data.CaptchaToken); err != nil {
+		respondCaptchaError(c, err)
 		return
 	}
 
@@ -467,6 +694,8 @@ func UserResetPassword(c *gin.Context) {
 	user.Password = pwd
 	user.VerifyToken = ""
 	user.VerifyTokenExpire = time.Time{}
+	// 重設密碼後所有裝置都需要重新登入
+	user.TokenVersion++
 
 	err = models.UpdateUser(&user)
 
@@ -477,6 +706,13 @@ func UserResetPassword(c *gin.Context) {
 		return
 	}
 
+	if err := revokeAllSessions(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Success",
 	})
@@ -0,0 +1,404 @@
+package views
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NCNUCodeOJ/BackendUser/models"
+	"github.com/NCNUCodeOJ/BackendUser/pkg"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	// 完成 passkey 註冊或登入的時間
+	webAuthnTimeout = 5 * time.Minute
+	// passkey 註冊與登入的 body 大小上限，attestation 帶有憑證鏈時也只有幾 KB
+	webAuthnMaxBodySize = 64 << 10
+)
+
+var webAuthn *pkg.WebAuthn
+
+// setupWebAuthn 設定 relying party，origin 預設為前端網址，RP ID 預設為第一個 origin 的網域
+func setupWebAuthn() {
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if origins == "" {
+		origins = os.Getenv("FrontendURL")
+	}
+	if origins == "" {
+		origins = "http://localhost"
+	}
+	webAuthn = &pkg.WebAuthn{
+		RPID:    os.Getenv("WEBAUTHN_RP_ID"),
+		RPName:  "NCNUOJ",
+		Origins: strings.Split(origins, ","),
+	}
+	if webAuthn.RPID == "" {
+		if u, err := url.Parse(webAuthn.Origins[0]); err == nil {
+			webAuthn.RPID = u.Hostname()
+		}
+	}
+}
+
+// webAuthnSession 簽發帶有 challenge 的 session token，讓驗證時不需要在伺服器保存狀態
+func webAuthnSession(purpose string, claims jwt.MapClaims) (challenge, session string, err error) {
+	if challenge, err = pkg.RandomToken(32); err != nil {
+		return
+	}
+	claims["challenge"] = challenge
+	session, _, err = generatePurposeToken(purpose, webAuthnTimeout, claims)
+	return
+}
+
+var pubKeyCredParams = []gin.H{
+	{"type": "public-key", "alg": pkg.COSEAlgES256},
+	{"type": "public-key", "alg": pkg.COSEAlgEdDSA},
+	{"type": "public-key", "alg": pkg.COSEAlgRS256},
+}
+
+// PasskeyRegisterOptions 產生註冊 passkey 的 PublicKeyCredentialCreationOptions
+func PasskeyRegisterOptions(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	user, err := models.UserDetailByID(userID)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": "no such user",
+		})
+		return
+	}
+
+	credentials, err := models.GetWebAuthnCredentialsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	exclude := []gin.H{}
+	for _, credential := range credentials {
+		exclude = append(exclude, gin.H{
+			"type": "public-key",
+			"id":   credential.CredentialID,
+		})
+	}
+
+	id := strconv.FormatUint(uint64(userID), 10)
+	challenge, session, err := webAuthnSession(purposeWebAuthnRegister, jwt.MapClaims{"id": id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": session,
+		"publicKey": gin.H{
+			"challenge": challenge,
+			"rp": gin.H{
+				"id":   webAuthn.RPID,
+				"name": webAuthn.RPName,
+			},
+			"user": gin.H{
+				"id":          pkg.WebAuthnEncode([]byte(id)),
+				"name":        user.UserName,
+				"displayName": user.RealName,
+			},
+			"pubKeyCredParams": pubKeyCredParams,
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"attestation":      "none",
+			"authenticatorSelection": gin.H{
+				"residentKey":        "required",
+				"requireResidentKey": true,
+				"userVerification":   "required",
+			},
+			"excludeCredentials": exclude,
+		},
+	})
+}
+
+// RegisterPasskey 驗證並儲存新的 passkey
+func RegisterPasskey(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	var data struct {
+		Session    string `json:"session"`
+		Name       string `json:"name"`
+		Credential struct {
+			Response struct {
+				ClientDataJSON    string `json:"clientDataJSON"`
+				AttestationObject string `json:"attestationObject"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, webAuthnMaxBodySize)
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	clientDataJSON, err1 := pkg.WebAuthnDecode(data.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := pkg.WebAuthnDecode(data.Credential.Response.AttestationObject)
+	if data.Session == "" || err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	claims, err := verifyPurposeToken(data.Session, purposeWebAuthnRegister)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "session is invalid",
+		})
+		return
+	}
+	if id, _ := claimUserID(claims); id != userID {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "session is invalid",
+		})
+		return
+	}
+
+	authData, algorithm, err := webAuthn.VerifyRegistration(claims["challenge"].(string), clientDataJSON, attestationObject)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	if err := consumePurposeToken(claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"message": "session is invalid",
+		})
+		return
+	}
+
+	credentialID := pkg.WebAuthnEncode(authData.CredentialID)
+	if _, err := models.WebAuthnCredentialByCredentialID(credentialID); err == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"message": "passkey is already registered",
+		})
+		return
+	}
+
+	if data.Name == "" {
+		data.Name = "Passkey"
+	}
+	credential := models.WebAuthnCredential{
+		UserID:       userID,
+		Name:         data.Name,
+		CredentialID: credentialID,
+		PublicKey:    authData.PublicKey,
+		Algorithm:    algorithm,
+		SignCount:    authData.SignCount,
+	}
+	if err := models.CreateWebAuthnCredential(&credential); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":    "passkey registered",
+		"passkey_id": credential.ID,
+	})
+}
+
+// GetPasskeys 列出使用者的 passkey
+func GetPasskeys(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	credentials, err := models.GetWebAuthnCredentialsByUserID(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	passkeys := []gin.H{}
+	for _, credential := range credentials {
+		var lastUsedAt interface{}
+		if credential.LastUsedAt != nil {
+			lastUsedAt = credential.LastUsedAt.Unix()
+		}
+		passkeys = append(passkeys, gin.H{
+			"passkey_id":   credential.ID,
+			"name":         credential.Name,
+			"created_at":   credential.CreatedAt.Unix(),
+			"last_used_at": lastUsedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"passkeys": passkeys,
+	})
+}
+
+// DeletePasskey 刪除 passkey
+func DeletePasskey(c *gin.Context) {
+	userID := c.MustGet("userID").(uint)
+	id, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "passkey id error",
+		})
+		return
+	}
+
+	deleted, err := models.DeleteWebAuthnCredential(userID, uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "passkey not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "delete passkey success",
+	})
+}
+
+// PasskeyLoginOptions 產生 passkey 登入的 PublicKeyCredentialRequestOptions
+func PasskeyLoginOptions(c *gin.Context) {
+	challenge, session, err := webAuthnSession(purposeWebAuthnLogin, jwt.MapClaims{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": session,
+		"publicKey": gin.H{
+			"challenge":        challenge,
+			"rpId":             webAuthn.RPID,
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"userVerification": "required",
+			"allowCredentials": []gin.H{},
+		},
+	})
+}
+
+// LoginPasskey 以 passkey 登入，passkey 已驗證使用者，不需要再輸入兩步驟驗證碼
+func LoginPasskey(c *gin.Context) {
+	var data struct {
+		Session    string `json:"session"`
+		Credential struct {
+			ID       string `json:"id"`
+			Response struct {
+				ClientDataJSON    string `json:"clientDataJSON"`
+				AuthenticatorData string `json:"authenticatorData"`
+				Signature         string `json:"signature"`
+				UserHandle        string `json:"userHandle"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, webAuthnMaxBodySize)
+	if err := c.BindJSON(&data); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "json format error",
+		})
+		return
+	}
+
+	response := data.Credential.Response
+	clientDataJSON, err1 := pkg.WebAuthnDecode(response.ClientDataJSON)
+	authData, err2 := pkg.WebAuthnDecode(response.AuthenticatorData)
+	signature, err3 := pkg.WebAuthnDecode(response.Signature)
+	userHandle, err4 := pkg.WebAuthnDecode(response.UserHandle)
+	if data.Session == "" || data.Credential.ID == "" || err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "data is not complete",
+		})
+		return
+	}
+
+	claims, err := verifyPurposeToken(data.Session, purposeWebAuthnLogin)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "session is invalid",
+		})
+		return
+	}
+
+	credential, err := models.WebAuthnCredentialByCredentialID(data.Credential.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"code":    http.StatusUnauthorized,
+				"message": "passkey is not registered",
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	if len(userHandle) > 0 && string(userHandle) != strconv.FormatUint(uint64(credential.UserID), 10) {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	verified, err := webAuthn.VerifyAssertion(claims["challenge"].(string), credential.PublicKey, clientDataJSON, authData, signature)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	// 有計數器的驗證器每次都會遞增，沒有遞增代表 passkey 可能被複製
+	if (verified.SignCount != 0 || credential.SignCount != 0) && verified.SignCount <= credential.SignCount {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "passkey verification failed",
+		})
+		return
+	}
+
+	if err := consumePurposeToken(claims); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"code":    http.StatusUnauthorized,
+			"message": "session is invalid",
+		})
+		return
+	}
+
+	now := time.Now()
+	credential.SignCount = verified.SignCount
+	credential.LastUsedAt = &now
+	if err := models.UpdateWebAuthnCredential(&credential); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "Server error",
+		})
+		return
+	}
+
+	loginSuccess(c, &credential.User, credential.User.UserName, loginMethodPasskey)
+}